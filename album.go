@@ -0,0 +1,247 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AlbumOptions contains the optional parameters used by SetAlbums.
+type AlbumOptions struct {
+	// Wait is how long to wait for the next message of an album before
+	// delivering it, 500ms if 0.
+	Wait time.Duration
+	// MaxWait is the longest an album is held since its first message,
+	// 3s if 0.
+	MaxWait time.Duration
+	// MaxSize is the number of messages after which an album is delivered
+	// right away, 10 if 0.
+	MaxSize int
+}
+
+// Album is a group of messages sent together, such as photos and videos,
+// which share the same MediaGroupID.
+type Album struct {
+	// ID is the MediaGroupID of the messages.
+	ID string
+	// Updates contains the updates of the messages ordered by message ID.
+	Updates []*Update
+}
+
+// Messages returns the messages of the album.
+func (a *Album) Messages() []*Message {
+	msgs := make([]*Message, len(a.Updates))
+	for i, u := range a.Updates {
+		msgs[i] = u.newMessage()
+	}
+	return msgs
+}
+
+// AlbumReceiver is an optional interface for Bot.
+// If a Bot implements it and SetAlbums has been called on the Dispatcher, the
+// messages of an album are delivered all at once to UpdateAlbum instead of
+// one by one to Update.
+// The context is the one of the first message of the album.
+type AlbumReceiver interface {
+	UpdateAlbum(ctx context.Context, album *Album)
+}
+
+// SetAlbums makes the Dispatcher buffer the messages belonging to the
+// same media group and deliver them together as an Album, once no message of
+// the group has arrived for opts.Wait or the album has been held for
+// opts.MaxWait or has reached opts.MaxSize messages.
+// The middlewares still see each message as it arrives, and the Bots not
+// implementing AlbumReceiver receive the messages one by one once the album
+// is complete.
+// The updates are processed synchronously with ProcessUpdate and in webhook
+// reply mode, so they're never aggregated there.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) SetAlbums(opts AlbumOptions) {
+	if opts.Wait <= 0 {
+		opts.Wait = 500 * time.Millisecond
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = 3 * time.Second
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 10
+	}
+
+	d.albums = &mediaGroups{
+		opts:    opts,
+		pending: make(map[albumKey]*pendingAlbum),
+		flush:   d.deliverAlbum,
+	}
+}
+
+// hold reports whether update has been held by the media group aggregator,
+// in which case it's completed once its album is delivered.
+// Updates are only held when run can postpone their completion.
+func (d *Dispatcher) hold(ctx context.Context, update *Update) bool {
+	if _, ok := ctx.Value(holdKey{}).(*bool); !ok || d.albums == nil || !d.albums.add(ctx, update) {
+		return false
+	}
+	return postpone(ctx)
+}
+
+// deliverAlbum delivers album to the Bot of its session and then completes
+// its updates, unless the Dispatcher has been shut down meanwhile.
+func (d *Dispatcher) deliverAlbum(ctx context.Context, album *Album) {
+	err := d.process(album.Updates[0], func(bot Bot) error {
+		if r, ok := unwrapBot(bot).(AlbumReceiver); ok {
+			r.UpdateAlbum(ctx, album)
+			return nil
+		}
+
+		for _, u := range album.Updates {
+			if err := callBot(ctx, bot, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errDispatcherClosed) {
+		return
+	}
+	if err != nil {
+		d.handleError(err)
+	}
+
+	for _, u := range album.Updates {
+		d.complete(u)
+	}
+}
+
+// newMessage returns the new message, channel post or business message
+// contained in the update, or nil if there's none.
+func (u Update) newMessage() *Message {
+	switch {
+	case u.Message != nil:
+		return u.Message
+	case u.ChannelPost != nil:
+		return u.ChannelPost
+	case u.BusinessMessage != nil:
+		return u.BusinessMessage
+	default:
+		return nil
+	}
+}
+
+// albumKey identifies a media group, whose IDs are only unique in a chat.
+type albumKey struct {
+	id     string
+	chatID int64
+}
+
+// pendingAlbum is an album whose messages are still being collected.
+type pendingAlbum struct {
+	ctx   context.Context
+	album Album
+	start time.Time
+	timer *time.Timer
+}
+
+// mediaGroups collects the messages of the media groups into albums.
+type mediaGroups struct {
+	opts    AlbumOptions
+	pending map[albumKey]*pendingAlbum
+	flush   func(ctx context.Context, album *Album)
+	mu      sync.Mutex
+}
+
+// add adds the update to its album and reports whether it has been held,
+// which happens if it contains a message belonging to a media group.
+func (m *mediaGroups) add(ctx context.Context, update *Update) bool {
+	msg := update.newMessage()
+	if msg == nil || msg.MediaGroupID == "" {
+		return false
+	}
+	key := albumKey{id: msg.MediaGroupID, chatID: msg.Chat.ID}
+
+	m.mu.Lock()
+	p, ok := m.pending[key]
+	if !ok {
+		p = &pendingAlbum{
+			ctx:   ctx,
+			album: Album{ID: msg.MediaGroupID},
+			start: time.Now(),
+		}
+		m.pending[key] = p
+	}
+	p.album.Updates = append(p.album.Updates, update)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	left := m.opts.MaxWait - time.Since(p.start)
+	if len(p.album.Updates) >= m.opts.MaxSize || left <= 0 {
+		delete(m.pending, key)
+		m.mu.Unlock()
+		m.deliver(p)
+		return true
+	}
+
+	if left > m.opts.Wait {
+		left = m.opts.Wait
+	}
+	p.timer = time.AfterFunc(left, func() {
+		m.expire(key, p)
+	})
+	m.mu.Unlock()
+	return true
+}
+
+// expire delivers the album p when its timer fires, unless it has been
+// delivered already.
+func (m *mediaGroups) expire(key albumKey, p *pendingAlbum) {
+	m.mu.Lock()
+	if m.pending[key] != p {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.pending, key)
+	m.mu.Unlock()
+
+	m.deliver(p)
+}
+
+// deliverAll delivers all the pending albums right away.
+func (m *mediaGroups) deliverAll() {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[albumKey]*pendingAlbum)
+	m.mu.Unlock()
+
+	for _, p := range pending {
+		p.timer.Stop()
+		m.deliver(p)
+	}
+}
+
+// deliver sorts the messages of the album p and passes it to m.flush.
+func (m *mediaGroups) deliver(p *pendingAlbum) {
+	sort.Slice(p.album.Updates, func(i, j int) bool {
+		return p.album.Updates[i].newMessage().ID < p.album.Updates[j].newMessage().ID
+	})
+	m.flush(p.ctx, &p.album)
+}
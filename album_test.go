@@ -0,0 +1,112 @@
+package echotron
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type albumBot chan *Album
+
+func (b albumBot) Update(u *Update) { b <- &Album{Updates: []*Update{u}} }
+
+func (b albumBot) UpdateAlbum(_ context.Context, a *Album) { b <- a }
+
+type ackJournal struct {
+	acked []int
+	mu    sync.Mutex
+}
+
+func (j *ackJournal) Append(*Update) error        { return nil }
+func (j *ackJournal) Pending() ([]*Update, error) { return nil, nil }
+func (j *ackJournal) Ack(id int) error {
+	j.mu.Lock()
+	j.acked = append(j.acked, id)
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *ackJournal) count() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.acked)
+}
+
+func albumUpdate(id int, group string) *Update {
+	return &Update{ID: id, Message: &Message{ID: id, MediaGroupID: group, Chat: Chat{ID: 1}}}
+}
+
+func TestAlbums(t *testing.T) {
+	bot := make(albumBot, 10)
+	journal := &ackJournal{}
+
+	d := NewDispatcher("token", func(int64) Bot { return bot })
+	d.SetAlbums(AlbumOptions{Wait: 50 * time.Millisecond, MaxSize: 3})
+	if err := d.SetJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of order, interleaved with an unrelated message and another album.
+	for _, u := range []*Update{
+		albumUpdate(3, "a"),
+		albumUpdate(1, "a"),
+		albumUpdate(10, "b"),
+		{ID: 20, Message: &Message{ID: 20, Chat: Chat{ID: 1}}},
+		albumUpdate(2, "a"),
+	} {
+		d.push(context.Background(), u, false)
+	}
+
+	albums := make(map[string][]int)
+	for len(albums) < 3 {
+		select {
+		case a := <-bot:
+			var ids []int
+			for _, m := range a.Messages() {
+				ids = append(ids, m.ID)
+			}
+			albums[a.ID] = ids
+		case <-time.After(time.Second):
+			t.Fatalf("albums not delivered, got %v", albums)
+		}
+	}
+
+	// Album "a" reached MaxSize, "b" was delivered after Wait.
+	if ids := albums["a"]; len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Fatalf("unexpected album a: %v", ids)
+	}
+	if ids := albums["b"]; len(ids) != 1 || ids[0] != 10 {
+		t.Fatalf("unexpected album b: %v", ids)
+	}
+	if ids := albums[""]; len(ids) != 1 || ids[0] != 20 {
+		t.Fatalf("unexpected single message: %v", ids)
+	}
+	waitFor(t, func() bool { return journal.count() == 5 })
+}
+
+func TestAlbumsMaxWait(t *testing.T) {
+	bot := make(albumBot, 20)
+
+	d := NewDispatcher("token", func(int64) Bot { return bot })
+	d.SetAlbums(AlbumOptions{Wait: 40 * time.Millisecond, MaxWait: 100 * time.Millisecond})
+
+	// A message every 20ms keeps the album open until MaxWait, the messages
+	// still pending are delivered on Shutdown.
+	var pushed int
+	for start := time.Now(); time.Since(start) < 250*time.Millisecond; pushed++ {
+		d.push(context.Background(), albumUpdate(pushed+1, "a"), false)
+		time.Sleep(20 * time.Millisecond)
+	}
+	d.Shutdown()
+
+	var albums, messages int
+	for len(bot) > 0 {
+		a := <-bot
+		albums++
+		messages += len(a.Updates)
+	}
+	if albums < 2 || messages != pushed {
+		t.Fatalf("expected %d messages in 2 albums at least, got %d in %d", pushed, messages, albums)
+	}
+}
@@ -19,6 +19,7 @@
 package echotron
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -72,9 +73,17 @@ func (a API) GetUpdates(opts *UpdateOptions) (res APIResponseUpdate, err error)
 	return res, a.lclient.get(a.base, "getUpdates", urlValues(opts), &res)
 }
 
+// getUpdates is like GetUpdates but the long polling request is cancelled when ctx is done.
+func (a API) getUpdates(ctx context.Context, opts *UpdateOptions) (res APIResponseUpdate, err error) {
+	return res, a.lclient.getContext(ctx, a.base, "getUpdates", urlValues(opts), &res)
+}
+
 // SetWebhook is used to specify a url and receive incoming updates via an outgoing webhook.
+// If opts.Certificate is set, the public key certificate is uploaded so that
+// Telegram can trust a self-signed certificate.
 func (a API) SetWebhook(webhookURL string, dropPendingUpdates bool, opts *WebhookOptions) (res APIResponseBase, err error) {
 	var (
+		cnt    []byte
 		vals   = make(url.Values)
 		keyVal = map[string]string{"url": webhookURL}
 	)
@@ -86,9 +95,20 @@ func (a API) SetWebhook(webhookURL string, dropPendingUpdates bool, opts *Webhoo
 
 	vals.Set("drop_pending_updates", btoa(dropPendingUpdates))
 	addValues(vals, opts)
-	url = fmt.Sprintf("%s?%s", strings.TrimSuffix(url, "/"), vals.Encode())
 
-	cnt, err := a.lclient.doPostForm(url, keyVal)
+	if opts != nil && opts.Certificate.path != "" {
+		var cert content
+
+		if cert, err = toContent("certificate", opts.Certificate); err != nil {
+			return
+		}
+		vals.Set("url", webhookURL)
+		url = fmt.Sprintf("%s?%s", strings.TrimSuffix(url, "/"), vals.Encode())
+		cnt, err = a.lclient.doPost(url, cert)
+	} else {
+		url = fmt.Sprintf("%s?%s", strings.TrimSuffix(url, "/"), vals.Encode())
+		cnt, err = a.lclient.doPostForm(url, keyVal)
+	}
 	if err != nil {
 		return
 	}
@@ -22,8 +22,9 @@ import "fmt"
 
 // APIError represents an error returned by the Telegram API.
 type APIError struct {
-	desc string
-	code int
+	desc       string
+	code       int
+	retryAfter int
 }
 
 // ErrorCode returns the error code received from the Telegram API.
@@ -36,6 +37,12 @@ func (a *APIError) Description() string {
 	return a.desc
 }
 
+// RetryAfter returns the number of seconds left to wait before the request
+// can be repeated, in case the flood control has been exceeded.
+func (a *APIError) RetryAfter() int {
+	return a.retryAfter
+}
+
 // Error returns the error string.
 func (a *APIError) Error() string {
 	return fmt.Sprintf("API error: %d %s", a.code, a.desc)
@@ -15,3 +15,7 @@ func TestDescription(_ *testing.T) {
 func TestError(_ *testing.T) {
 	_ = a.Error()
 }
+
+func TestRetryAfter(_ *testing.T) {
+	a.RetryAfter()
+}
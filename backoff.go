@@ -0,0 +1,109 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Bounds of the delay between two retries of a failing polling request.
+var (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// backoff computes exponentially growing delays with jitter between the
+// retries of a failing request.
+type backoff struct {
+	attempt int
+}
+
+// next returns the delay to wait before the next retry.
+func (b *backoff) next() time.Duration {
+	d := minRetryDelay << b.attempt
+	if d <= 0 || d >= maxRetryDelay {
+		d = maxRetryDelay
+	} else {
+		b.attempt++
+	}
+
+	// Pick a random delay in [d/2, d] so that many clients failing at the
+	// same time don't retry all together.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset is called after a successful request.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// retry returns nil after waiting the appropriate delay if the request
+// that failed with err can be retried, otherwise it returns the error
+// that made the caller give up.
+func (b *backoff) retry(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if isFatal(err) {
+		return err
+	}
+	return b.wait(ctx, err)
+}
+
+// wait blocks for the next delay, or for the time requested by Telegram if
+// err is a flood control error, or until ctx is done.
+func (b *backoff) wait(ctx context.Context, err error) error {
+	delay := b.next()
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter() > 0 {
+		delay = time.Duration(apiErr.RetryAfter()) * time.Second
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isFatal reports whether err is an error that won't go away by repeating
+// the request, such as an invalid token or a conflict with another instance
+// of the bot receiving updates.
+func isFatal(err error) bool {
+	var apiErr *APIError
+
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,32 @@
+package echotron
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBackoffNext(t *testing.T) {
+	var b backoff
+
+	for i := 0; i < 20; i++ {
+		if d := b.next(); d < minRetryDelay/2 || d > maxRetryDelay {
+			t.Fatalf("delay %v out of bounds", d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > minRetryDelay {
+		t.Fatalf("expected delay to be reset, got %v", d)
+	}
+}
+
+func TestBackoffRetryFatal(t *testing.T) {
+	var (
+		b   backoff
+		err = &APIError{code: 401, desc: "Unauthorized"}
+	)
+
+	if ret := b.retry(context.Background(), err); ret != err {
+		t.Fatalf("expected fatal error to be returned, got %v", ret)
+	}
+}
@@ -0,0 +1,429 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxCallbackDataSize is the maximum size in bytes of the callback data of an
+// inline keyboard button.
+const MaxCallbackDataSize = 64
+
+// ErrCallbackDataTooLong is returned by CallbackCodec when the encoded data
+// exceeds MaxCallbackDataSize and no CallbackStore is set.
+var ErrCallbackDataTooLong = errors.New("echotron: callback data longer than 64 bytes")
+
+// CallbackStore keeps the callback data too long to fit in a button, which is
+// replaced by a short key.
+type CallbackStore interface {
+	// Save stores data and returns the key to retrieve it.
+	Save(data string) (key string, err error)
+	// Load returns the data stored with key.
+	Load(key string) (data string, err error)
+}
+
+// errCallbackExpired is returned by MemoryCallbackStore for unknown keys.
+var errCallbackExpired = errors.New("echotron: callback data expired")
+
+// MemoryCallbackStore is a CallbackStore that keeps up to a fixed number of
+// entries in memory, discarding the oldest ones when full.
+type MemoryCallbackStore struct {
+	data  map[string]string
+	keys  []string
+	next  int
+	limit int
+	mu    sync.Mutex
+}
+
+// NewMemoryCallbackStore returns a new MemoryCallbackStore that holds up to
+// limit entries, or 1024 if limit isn't positive.
+func NewMemoryCallbackStore(limit int) *MemoryCallbackStore {
+	if limit <= 0 {
+		limit = 1024
+	}
+
+	return &MemoryCallbackStore{
+		data:  make(map[string]string, limit),
+		keys:  make([]string, limit),
+		limit: limit,
+	}
+}
+
+// Save stores data under a new random key.
+func (m *MemoryCallbackStore) Save(data string) (string, error) {
+	b := make([]byte, 9)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(b)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, m.keys[m.next])
+	m.keys[m.next] = key
+	m.next = (m.next + 1) % m.limit
+	m.data[key] = data
+	return key, nil
+}
+
+// Load returns the data stored with key, or an error if it has been discarded.
+func (m *MemoryCallbackStore) Load(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.data[key]
+	if !ok {
+		return "", errCallbackExpired
+	}
+	return data, nil
+}
+
+// CallbackCodec packs the values of the struct type T into compact callback
+// data, made of a prefix identifying the type followed by the fields separated
+// by colons, as in 'page:3:asc', and unpacks them back.
+// The exported fields of T must be strings, booleans, integers or floats.
+type CallbackCodec[T any] struct {
+	store  CallbackStore
+	prefix string
+	fields []int
+}
+
+// NewCallbackCodec returns a new CallbackCodec for T whose data starts with
+// prefix, which must not contain colons nor hashes.
+func NewCallbackCodec[T any](prefix string) (*CallbackCodec[T], error) {
+	if prefix == "" || strings.ContainsAny(prefix, ":#") {
+		return nil, fmt.Errorf("echotron: invalid callback prefix %q", prefix)
+	}
+
+	var zero T
+	t := reflect.TypeOf(zero)
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("echotron: callback type %v is not a struct", t)
+	}
+
+	c := &CallbackCodec[T]{prefix: prefix}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		switch f.Type.Kind() {
+		case reflect.String, reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			c.fields = append(c.fields, i)
+		default:
+			return nil, fmt.Errorf("echotron: unsupported type %v of callback field %s", f.Type, f.Name)
+		}
+	}
+	return c, nil
+}
+
+// SetStore sets the CallbackStore in which the data longer than
+// MaxCallbackDataSize is saved, replaced in the button by the prefix, a hash
+// and the key returned by the store.
+func (c *CallbackCodec[T]) SetStore(s CallbackStore) {
+	c.store = s
+}
+
+// Prefix returns the prefix of the data produced by the codec.
+func (c *CallbackCodec[T]) Prefix() string {
+	return c.prefix
+}
+
+// Encode packs v into callback data, failing with ErrCallbackDataTooLong if it
+// exceeds MaxCallbackDataSize and no CallbackStore is set.
+func (c *CallbackCodec[T]) Encode(v T) (string, error) {
+	var b strings.Builder
+
+	b.WriteString(c.prefix)
+	rv := reflect.ValueOf(v)
+	for _, i := range c.fields {
+		b.WriteByte(':')
+		b.WriteString(encodeField(rv.Field(i)))
+	}
+
+	data := b.String()
+	if len(data) <= MaxCallbackDataSize {
+		return data, nil
+	}
+	if c.store == nil {
+		return "", ErrCallbackDataTooLong
+	}
+
+	key, err := c.store.Save(data)
+	if err != nil {
+		return "", err
+	}
+	if data = c.prefix + "#" + key; len(data) > MaxCallbackDataSize {
+		return "", ErrCallbackDataTooLong
+	}
+	return data, nil
+}
+
+// Button returns an inline keyboard button with the given text carrying v as
+// callback data.
+func (c *CallbackCodec[T]) Button(text string, v T) (InlineKeyboardButton, error) {
+	data, err := c.Encode(v)
+	if err != nil {
+		return InlineKeyboardButton{}, err
+	}
+	return InlineKeyboardButton{Text: text, CallbackData: data}, nil
+}
+
+// Match reports whether data has been produced by the codec.
+func (c *CallbackCodec[T]) Match(data string) bool {
+	rest := strings.TrimPrefix(data, c.prefix)
+	return len(rest) < len(data) && (rest == "" || rest[0] == ':' || rest[0] == '#')
+}
+
+// Decode unpacks data produced by Encode.
+func (c *CallbackCodec[T]) Decode(data string) (T, error) {
+	var v T
+
+	if !c.Match(data) {
+		return v, fmt.Errorf("echotron: callback data %q doesn't match prefix %q", data, c.prefix)
+	}
+
+	if rest := data[len(c.prefix):]; strings.HasPrefix(rest, "#") {
+		if c.store == nil {
+			return v, errors.New("echotron: no store for stored callback data")
+		}
+
+		var err error
+		if data, err = c.store.Load(rest[1:]); err != nil {
+			return v, err
+		}
+	}
+
+	parts := splitEscaped(strings.TrimPrefix(data, c.prefix))
+	if len(parts) != len(c.fields) {
+		return v, fmt.Errorf("echotron: callback data %q has %d fields, expected %d", data, len(parts), len(c.fields))
+	}
+
+	rv := reflect.ValueOf(&v).Elem()
+	for i, idx := range c.fields {
+		if err := decodeField(rv.Field(idx), parts[i]); err != nil {
+			return v, fmt.Errorf("echotron: callback field %s: %w", rv.Type().Field(idx).Name, err)
+		}
+	}
+	return v, nil
+}
+
+// encodeField returns the compact representation of the field value v, with
+// integers in base 36 and colons escaped.
+func encodeField(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			return "1"
+		}
+		return "0"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 36)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 36)
+	default:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	}
+}
+
+// decodeField parses s into the field v.
+func decodeField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		v.SetBool(s == "1")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 36, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 36, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	}
+	return nil
+}
+
+// splitEscaped splits the fields following each unescaped colon of s, removing
+// the escapes.
+func splitEscaped(s string) []string {
+	var (
+		parts   []string
+		cur     strings.Builder
+		escaped bool
+	)
+
+	if s == "" {
+		return nil
+	}
+
+	// s starts with the separator of the first field.
+	for _, r := range s[1:] {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ':':
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	return append(parts, cur.String())
+}
+
+// CallbackHandler handles a callback query.
+type CallbackHandler func(ctx context.Context, update *Update, data string)
+
+// callbackRoute is a handler registered in a CallbackRouter.
+type callbackRoute struct {
+	filter  Filter
+	match   func(data string) bool
+	handler CallbackHandler
+}
+
+// CallbackRouter dispatches the callback queries to the handlers registered
+// for their data, trying them in the order in which they've been registered.
+type CallbackRouter struct {
+	routes []callbackRoute
+	mu     sync.RWMutex
+}
+
+// NewCallbackRouter returns a new empty CallbackRouter.
+func NewCallbackRouter() *CallbackRouter {
+	return &CallbackRouter{}
+}
+
+// HandleFunc registers h for the callback data for which match returns true.
+func (r *CallbackRouter) HandleFunc(match func(data string) bool, h CallbackHandler) {
+	r.mu.Lock()
+	r.routes = append(r.routes, callbackRoute{match: match, handler: h})
+	r.mu.Unlock()
+}
+
+// HandleFilter registers h for the callback queries of the updates matched
+// by f, whatever their data.
+func (r *CallbackRouter) HandleFilter(f Filter, h CallbackHandler) {
+	r.mu.Lock()
+	r.routes = append(r.routes, callbackRoute{filter: f, handler: h})
+	r.mu.Unlock()
+}
+
+// HandlePrefix registers h for the callback data starting with prefix.
+func (r *CallbackRouter) HandlePrefix(prefix string, h CallbackHandler) {
+	r.HandleFunc(func(data string) bool {
+		return strings.HasPrefix(data, prefix)
+	}, h)
+}
+
+// HandlePattern registers h for the callback data matching the regular
+// expression pattern, and panics if it doesn't compile.
+func (r *CallbackRouter) HandlePattern(pattern string, h CallbackHandler) {
+	re := regexp.MustCompile(pattern)
+	r.HandleFunc(re.MatchString, h)
+}
+
+// HandleCallback registers h on r for the callback data produced by codec,
+// passing it the decoded value.
+// Data that can't be decoded, as it happens when it's expired from the
+// CallbackStore, is passed to onError, if not nil.
+func HandleCallback[T any](r *CallbackRouter, codec *CallbackCodec[T], h func(ctx context.Context, update *Update, v T), onError func(ctx context.Context, update *Update, err error)) {
+	r.HandleFunc(codec.Match, func(ctx context.Context, update *Update, data string) {
+		v, err := codec.Decode(data)
+		if err != nil {
+			if onError != nil {
+				onError(ctx, update, err)
+			}
+			return
+		}
+		h(ctx, update, v)
+	})
+}
+
+// Route calls the first handler matching the data of the callback query of
+// update, if any, and reports whether it did.
+func (r *CallbackRouter) Route(ctx context.Context, update *Update) bool {
+	if update.CallbackQuery == nil {
+		return false
+	}
+	data := update.CallbackQuery.Data
+
+	// The routes are matched and called without holding the lock, so that
+	// the handlers can register new routes.
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+
+	for _, route := range routes {
+		if (route.filter != nil && route.filter(update)) || (route.match != nil && route.match(data)) {
+			route.handler(ctx, update, data)
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns a Middleware that routes the callback queries with Route
+// and passes all the other updates to the next Handler.
+func (r *CallbackRouter) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if !r.Route(ctx, update) {
+				next(ctx, update)
+			}
+		}
+	}
+}
+
+// AllowedUpdates returns the update types handled by the router, so that it
+// can be registered with Dispatcher.Subscribe.
+func (r *CallbackRouter) AllowedUpdates() []UpdateType {
+	return []UpdateType{CallbackQueryUpdate}
+}
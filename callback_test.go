@@ -0,0 +1,148 @@
+package echotron
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pageData struct {
+	Sort  string
+	Page  int
+	Asc   bool
+	Score float64
+	Owner uint64
+	note  string
+}
+
+func TestCallbackCodec(t *testing.T) {
+	codec, err := NewCallbackCodec[pageData]("page")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := pageData{Sort: `a:b\c`, Page: 35, Asc: true, Score: 1.5, Owner: 1 << 40, note: "ignored"}
+	data, err := codec.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != `page:a\:b\\c:z:1:1.5:e13wu1og` {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	out, err := codec.Decode(data)
+	in.note = ""
+	if err != nil || out != in {
+		t.Fatalf("expected %+v, got %+v (%v)", in, out, err)
+	}
+
+	if codec.Match("pages:1") || !codec.Match("page:1") || !codec.Match("page#key") {
+		t.Fatal("unexpected match")
+	}
+	if _, err := codec.Decode("page:1"); err == nil {
+		t.Fatal("expected an error for missing fields")
+	}
+
+	long := pageData{Sort: strings.Repeat("x", 70)}
+	if _, err := codec.Encode(long); !errors.Is(err, ErrCallbackDataTooLong) {
+		t.Fatalf("expected ErrCallbackDataTooLong, got %v", err)
+	}
+
+	codec.SetStore(NewMemoryCallbackStore(1))
+	btn, err := codec.Button("Next", long)
+	if err != nil || len(btn.CallbackData) > MaxCallbackDataSize || !strings.HasPrefix(btn.CallbackData, "page#") {
+		t.Fatalf("unexpected button %+v (%v)", btn, err)
+	}
+	if out, err := codec.Decode(btn.CallbackData); err != nil || out != long {
+		t.Fatalf("expected %+v, got %+v (%v)", long, out, err)
+	}
+
+	// The store holds a single entry, so the first one expires.
+	codec.Encode(long)
+	if _, err := codec.Decode(btn.CallbackData); err == nil {
+		t.Fatal("expected an error for expired data")
+	}
+
+	if _, err := NewCallbackCodec[struct{ M map[string]int }]("m"); err == nil {
+		t.Fatal("expected an error for unsupported fields")
+	}
+	if _, err := NewCallbackCodec[pageData]("a:b"); err == nil {
+		t.Fatal("expected an error for an invalid prefix")
+	}
+}
+
+func TestCallbackRouter(t *testing.T) {
+	var got []string
+
+	codec, _ := NewCallbackCodec[pageData]("page")
+	r := NewCallbackRouter()
+	HandleCallback(r, codec, func(_ context.Context, _ *Update, v pageData) {
+		got = append(got, "page "+v.Sort)
+	}, func(_ context.Context, _ *Update, err error) {
+		got = append(got, "error")
+	})
+	r.HandlePrefix("vote:", func(_ context.Context, _ *Update, data string) {
+		got = append(got, data)
+	})
+	r.HandlePattern(`^del:\d+$`, func(_ context.Context, _ *Update, data string) {
+		got = append(got, data)
+	})
+
+	var passed int
+	h := r.Middleware()(func(_ context.Context, _ *Update) { passed++ })
+
+	data, _ := codec.Encode(pageData{Sort: "asc"})
+	for _, d := range []string{data, "page:x", "vote:up", "del:42", "del:x"} {
+		h(context.Background(), &Update{CallbackQuery: &CallbackQuery{Data: d}})
+	}
+	h(context.Background(), &Update{Message: &Message{}})
+
+	expected := []string{"page asc", "error", "vote:up", "del:42"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") || passed != 2 {
+		t.Fatalf("unexpected routing: %v, passed %d", got, passed)
+	}
+}
+
+func TestCallbackRouterFilter(t *testing.T) {
+	var got string
+
+	r := NewCallbackRouter()
+	r.HandleFilter(InChannel(), func(_ context.Context, _ *Update, data string) {
+		got = data
+	})
+
+	channel := &Update{CallbackQuery: &CallbackQuery{
+		Data:    "vote",
+		Message: &Message{Chat: Chat{Type: "channel"}},
+	}}
+	if r.Route(context.Background(), &Update{CallbackQuery: &CallbackQuery{Data: "x"}}) {
+		t.Fatal("unexpected route")
+	}
+	if !r.Route(context.Background(), channel) || got != "vote" {
+		t.Fatalf("expected vote, got %q", got)
+	}
+}
+
+func TestCallbackRouterRegisterFromHandler(t *testing.T) {
+	r := NewCallbackRouter()
+	r.HandlePrefix("open:", func(context.Context, *Update, string) {
+		r.HandlePrefix("close:", func(context.Context, *Update, string) {})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		r.Route(context.Background(), &Update{CallbackQuery: &CallbackQuery{Data: "open:1"}})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("registering a route from a handler deadlocked")
+	}
+	if !r.Route(context.Background(), &Update{CallbackQuery: &CallbackQuery{Data: "close:1"}}) {
+		t.Fatal("route registered from a handler not found")
+	}
+}
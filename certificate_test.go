@@ -0,0 +1,41 @@
+package echotron
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestNewSelfSignedCert(t *testing.T) {
+	for _, host := range []string{"example.com", "127.0.0.1"} {
+		certPEM, keyPEM, err := NewSelfSignedCert(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			t.Fatal(err)
+		}
+
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := isSelfSigned(certPEM); !ok || err != nil {
+			t.Fatalf("expected certificate for %s to be self-signed: %v", host, err)
+		}
+	}
+}
+
+func TestIsSelfSignedInvalid(t *testing.T) {
+	if _, err := isSelfSigned([]byte("not a certificate")); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Command is a bot command parsed from a message.
+type Command struct {
+	// Message is the message containing the command.
+	Message *Message
+	// Name is the name of the command, lowercase and without the leading
+	// slash nor the bot username.
+	Name string
+	// Mention is the username of the bot the command is addressed to, as in
+	// '/start@ExampleBot', or an empty string.
+	Mention string
+	// RawArgs is the text following the command.
+	RawArgs string
+	// Args contains the arguments of the command, separated by spaces unless
+	// enclosed in quotes.
+	Args []string
+}
+
+// ParseCommand returns the first bot command of the text or the caption of m,
+// found through its entities, so that commands not at the beginning of the
+// message are recognized as well.
+func ParseCommand(m *Message) (*Command, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	text, entities := m.Text, m.Entities
+	if text == "" {
+		text, entities = m.Caption, m.CaptionEntities
+	}
+
+	// Entity offsets are expressed in UTF-16 code units.
+	units := utf16.Encode([]rune(text))
+	for _, e := range entities {
+		// A command is at least the slash and one character long, malformed
+		// entities are skipped.
+		if e.Type != BotCommandEntity || e.Offset < 0 || e.Length < 2 || e.Offset+e.Length > len(units) {
+			continue
+		}
+
+		name := string(utf16.Decode(units[e.Offset+1 : e.Offset+e.Length]))
+		raw := strings.TrimSpace(string(utf16.Decode(units[e.Offset+e.Length:])))
+		cmd := &Command{
+			Message: m,
+			RawArgs: raw,
+			Args:    SplitArgs(raw),
+		}
+
+		cmd.Name, cmd.Mention, _ = strings.Cut(name, "@")
+		cmd.Name = strings.ToLower(cmd.Name)
+		return cmd, true
+	}
+	return nil, false
+}
+
+// SplitArgs splits s into arguments separated by spaces.
+// Spaces within single or double quotes, including the typographic ones, don't
+// separate arguments, and a backslash escapes the following character outside
+// of single quotes.
+func SplitArgs(s string) []string {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+
+		case r == '“':
+			quote, inArg = '”', true
+
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// CommandHandler handles a bot command.
+type CommandHandler func(ctx context.Context, update *Update, cmd *Command)
+
+// CommandRouter dispatches the bot commands to the handlers registered for
+// them and keeps the lists of commands to publish with SetMyCommands, one for
+// each combination of scope and language.
+type CommandRouter struct {
+	api      API
+	username string
+	handlers map[string]CommandHandler
+	sets     []CommandOptions
+	commands map[CommandOptions][]BotCommand
+	notFound CommandHandler
+	mu       sync.RWMutex
+}
+
+// NewCommandRouter returns a new CommandRouter for the bot of api, whose
+// username is retrieved with GetMe so that the commands addressed to other
+// bots, as in '/start@OtherBot', are ignored.
+func NewCommandRouter(api API) (*CommandRouter, error) {
+	res, err := api.GetMe()
+	if err != nil {
+		return nil, err
+	}
+	if res.Result == nil {
+		return nil, errors.New("echotron: empty GetMe result")
+	}
+
+	return &CommandRouter{
+		api:      api,
+		username: res.Result.Username,
+		handlers: make(map[string]CommandHandler),
+		commands: make(map[CommandOptions][]BotCommand),
+	}, nil
+}
+
+// Handle registers h as the handler of the command with the given name,
+// without the leading slash.
+// If description isn't empty, the command is added to the default command set,
+// the one without scope and language.
+func (r *CommandRouter) Handle(name, description string, h CommandHandler) {
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+
+	r.mu.Lock()
+	r.handlers[name] = h
+	r.mu.Unlock()
+
+	if description != "" {
+		r.Describe(CommandOptions{}, name, description)
+	}
+}
+
+// Describe adds the command with the given name to the command set of the
+// scope and the language of set, replacing its description if already there.
+// The command sets only affect what's published with Publish, not how the
+// commands are routed.
+func (r *CommandRouter) Describe(set CommandOptions, name, description string) {
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cmds, ok := r.commands[set]
+	if !ok {
+		r.sets = append(r.sets, set)
+	}
+
+	for i, c := range cmds {
+		if c.Command == name {
+			cmds[i].Description = description
+			return
+		}
+	}
+	r.commands[set] = append(cmds, BotCommand{Command: name, Description: description})
+}
+
+// NotFound sets the handler called with the commands addressed to the bot for
+// which no handler has been registered.
+func (r *CommandRouter) NotFound(h CommandHandler) {
+	r.mu.Lock()
+	r.notFound = h
+	r.mu.Unlock()
+}
+
+// Publish sends each command set to Telegram with SetMyCommands, in the order
+// in which the sets have been first described.
+func (r *CommandRouter) Publish() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, set := range r.sets {
+		set := set
+		if _, err := r.api.SetMyCommands(&set, r.commands[set]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Route calls the handler of the command contained in the message of update,
+// if any, and reports whether it did.
+// Commands addressed to other bots are ignored.
+func (r *CommandRouter) Route(ctx context.Context, update *Update) bool {
+	cmd, ok := ParseCommand(update.Message)
+	if !ok || (cmd.Mention != "" && !strings.EqualFold(cmd.Mention, r.username)) {
+		return false
+	}
+
+	r.mu.RLock()
+	h, ok := r.handlers[cmd.Name]
+	if !ok {
+		h = r.notFound
+	}
+	r.mu.RUnlock()
+
+	if h == nil {
+		return false
+	}
+	h(ctx, update, cmd)
+	return true
+}
+
+// Middleware returns a Middleware that routes the commands with Route and
+// passes all the other updates to the next Handler.
+func (r *CommandRouter) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if !r.Route(ctx, update) {
+				next(ctx, update)
+			}
+		}
+	}
+}
+
+// AllowedUpdates returns the update types handled by the router, so that it
+// can be registered with Dispatcher.Subscribe.
+func (r *CommandRouter) AllowedUpdates() []UpdateType {
+	return []UpdateType{MessageUpdate}
+}
@@ -0,0 +1,124 @@
+package echotron
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	// The emoji takes two UTF-16 code units.
+	m := &Message{
+		Text:     "😀 /Start@ExampleBot foo \"bar baz\"",
+		Entities: []*MessageEntity{{Type: BotCommandEntity, Offset: 3, Length: 17}},
+	}
+
+	cmd, ok := ParseCommand(m)
+	if !ok {
+		t.Fatal("command not found")
+	}
+	if cmd.Name != "start" || cmd.Mention != "ExampleBot" || cmd.RawArgs != `foo "bar baz"` {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	if !reflect.DeepEqual(cmd.Args, []string{"foo", "bar baz"}) {
+		t.Fatalf("unexpected arguments %q", cmd.Args)
+	}
+
+	if _, ok := ParseCommand(&Message{Text: "/start"}); ok {
+		t.Fatal("command found without entities")
+	}
+	if _, ok := ParseCommand(nil); ok {
+		t.Fatal("command found in nil message")
+	}
+
+	for _, length := range []int{-3, 0, 1} {
+		m := &Message{Text: "/start", Entities: []*MessageEntity{{Type: BotCommandEntity, Offset: 2, Length: length}}}
+		if _, ok := ParseCommand(m); ok {
+			t.Fatalf("command found in an entity of length %d", length)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := map[string][]string{
+		"":                     nil,
+		"  a  b ":              {"a", "b"},
+		`"a b" 'c d' “e f”`:    {"a b", "c d", "e f"},
+		`a\ b "c \"d\"" 'e\f'`: {"a b", `c "d"`, `e\f`},
+		`x"y z"w`:              {"xy zw"},
+		`""`:                   {""},
+	}
+
+	for in, expected := range tests {
+		if args := SplitArgs(in); !reflect.DeepEqual(args, expected) {
+			t.Errorf("SplitArgs(%q): expected %q, got %q", in, expected, args)
+		}
+	}
+}
+
+func TestCommandRouter(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		published []string
+		handled   []string
+	)
+
+	api := fakeAPI(t, func(method string, r *http.Request) string {
+		switch method {
+		case "getMe":
+			return `{"ok":true,"result":{"username":"ExampleBot"}}`
+		case "setMyCommands":
+			mu.Lock()
+			published = append(published, r.FormValue("language_code")+" "+r.FormValue("scope")+" "+r.FormValue("commands"))
+			mu.Unlock()
+		}
+		return `{"ok":true,"result":true}`
+	})
+
+	router, err := NewCommandRouter(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(_ context.Context, _ *Update, cmd *Command) {
+		handled = append(handled, cmd.Name)
+	}
+	router.Handle("/start", "Start the bot", handler)
+	router.Handle("secret", "", handler)
+	router.Describe(CommandOptions{LanguageCode: "it"}, "start", "Avvia il bot")
+	router.Describe(CommandOptions{Scope: BotCommandScope{Type: BCSTAllGroupChats}}, "start", "Start")
+	router.Describe(CommandOptions{Scope: BotCommandScope{Type: BCSTAllGroupChats}}, "start", "Start the bot")
+
+	var passed int
+	h := router.Middleware()(func(_ context.Context, _ *Update) { passed++ })
+
+	command := func(text string, length int) *Update {
+		return &Update{Message: &Message{
+			Text:     text,
+			Entities: []*MessageEntity{{Type: BotCommandEntity, Length: length}},
+		}}
+	}
+	h(context.Background(), command("/start", 6))
+	h(context.Background(), command("/secret@examplebot", 18))
+	h(context.Background(), command("/start@OtherBot", 15))
+	h(context.Background(), command("/unknown", 8))
+	h(context.Background(), &Update{Message: &Message{Text: "hello"}})
+
+	if !reflect.DeepEqual(handled, []string{"start", "secret"}) || passed != 3 {
+		t.Fatalf("unexpected routing: handled %v, passed %d", handled, passed)
+	}
+
+	if err := router.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`  [{"command":"start","description":"Start the bot"}]`,
+		`it  [{"command":"start","description":"Avvia il bot"}]`,
+		` {"type":"all_group_chats","chat_id":0,"user_id":0} [{"command":"start","description":"Start the bot"}]`,
+	}
+	if !reflect.DeepEqual(published, expected) {
+		t.Fatalf("unexpected published commands:\n%q", published)
+	}
+}
@@ -0,0 +1,441 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConversationState describes a named state of a ConversationFlow.
+type ConversationState struct {
+	// Handle processes an update received while the conversation is in the
+	// state and returns the name of the next state.
+	// Returning the empty string ends the conversation, which goes back to
+	// the initial state with its data cleared.
+	Handle func(ctx context.Context, c *Conversation, update *Update) string
+	// Timeout is how long the conversation can stay in the state without
+	// receiving updates, 0 means forever.
+	Timeout time.Duration
+	// OnTimeout is called when the Timeout expires and returns the name of
+	// the next state, if nil the conversation ends.
+	OnTimeout func(c *Conversation) string
+}
+
+// ConversationFlow is the definition of a state machine shared by all the
+// conversations created from it.
+// Its methods must be called before the conversations start receiving updates.
+type ConversationFlow struct {
+	initial  string
+	states   map[string]ConversationState
+	cancel   string
+	username string
+	store    SessionStore
+	onCancel func(ctx context.Context, c *Conversation, update *Update)
+}
+
+// NewConversationFlow returns a new ConversationFlow whose conversations
+// start in the initial state.
+func NewConversationFlow(initial string) *ConversationFlow {
+	return &ConversationFlow{
+		initial: initial,
+		states:  make(map[string]ConversationState),
+	}
+}
+
+// Handle adds the state called name to the flow, replacing the one with the
+// same name, if any.
+func (f *ConversationFlow) Handle(name string, s ConversationState) {
+	f.states[name] = s
+}
+
+// SetCancel sets the command, without the leading slash, that ends the
+// conversation from any state.
+// The fn function, if not nil, is called before the conversation ends, for
+// example to notify the user.
+func (f *ConversationFlow) SetCancel(command string, fn func(ctx context.Context, c *Conversation, update *Update)) {
+	f.cancel = strings.ToLower(strings.TrimPrefix(command, "/"))
+	f.onCancel = fn
+}
+
+// SetSessionStore sets the SessionStore in which the conversations save their
+// state as soon as a timeout moves them to another state, so that OnTimeout
+// isn't called again after a restart.
+// It must be the same SessionStore set on the Dispatcher, and it must only be
+// used when the Conversations are the Bots of the sessions, not when they're
+// embedded in them.
+// Without it, the transitions made by a timeout are saved along with the next
+// update, so OnTimeout should be idempotent.
+func (f *ConversationFlow) SetSessionStore(s SessionStore) {
+	f.store = s
+}
+
+// SetUsername sets the username of the bot, so that in groups the cancel
+// command is recognized when addressed to it, as in '/cancel@YourBot'.
+// Commands addressed to other bots, or to any bot if the username isn't set,
+// never cancel the conversation.
+func (f *ConversationFlow) SetUsername(username string) {
+	f.username = strings.TrimPrefix(username, "@")
+}
+
+// NewConversation returns a new Conversation with the chat of chatID in the
+// initial state of the flow.
+func (f *ConversationFlow) NewConversation(chatID int64) *Conversation {
+	return &Conversation{
+		ChatID: chatID,
+		flow:   f,
+		state:  f.initial,
+		data:   make(map[string]string),
+	}
+}
+
+// NewBot is a NewBotFn that returns a new Conversation, so that the flow can
+// be passed directly to NewDispatcher.
+func (f *ConversationFlow) NewBot(chatID int64) Bot {
+	return f.NewConversation(chatID)
+}
+
+// Conversation is an instance of a ConversationFlow with a chat.
+// It implements Bot and can be used either as the Bot of a session or
+// embedded in one.
+// It implements encoding.BinaryMarshaler and encoding.BinaryUnmarshaler as
+// well, so that with a SessionStore the conversation resumes from its last
+// state after a restart.
+// The transitions made by a timeout are saved along with the next update,
+// unless the flow has a SessionStore.
+type Conversation struct {
+	// ChatID is the ID of the chat of the conversation.
+	ChatID int64
+
+	flow *ConversationFlow
+	// run serializes the calls to the handlers, mu guards the fields below.
+	run      sync.Mutex
+	mu       sync.Mutex
+	state    string
+	next     string
+	hasNext  bool
+	data     map[string]string
+	deadline time.Time
+	timer    *time.Timer
+	gen      uint64
+	stopped  bool
+}
+
+// conversationState is the serialized form of a Conversation.
+type conversationState struct {
+	State    string            `json:"state"`
+	Data     map[string]string `json:"data,omitempty"`
+	Deadline time.Time         `json:"deadline,omitempty"`
+}
+
+// Update calls UpdateContext with a background context.
+func (c *Conversation) Update(update *Update) {
+	c.UpdateContext(context.Background(), update)
+}
+
+// UpdateContext passes update to the handler of the current state and moves
+// the conversation to the state it returns.
+// A message containing the cancel command of the flow ends the conversation
+// instead.
+// It panics if the handler returns the name of a state that doesn't exist.
+func (c *Conversation) UpdateContext(ctx context.Context, update *Update) {
+	c.run.Lock()
+	defer c.release()
+
+	if c.isCancel(update) {
+		if c.flow.onCancel != nil {
+			c.flow.onCancel(ctx, c, update)
+		}
+		c.transition("")
+		return
+	}
+
+	s, ok := c.flow.states[c.State()]
+	if !ok || s.Handle == nil {
+		return
+	}
+	if err := c.transition(s.Handle(ctx, c, update)); err != nil {
+		panic(err)
+	}
+}
+
+// isCancel reports whether update contains the cancel command of the flow.
+func (c *Conversation) isCancel(update *Update) bool {
+	if c.flow.cancel == "" {
+		return false
+	}
+
+	msg := update.Message
+	if msg == nil {
+		msg = update.EditedMessage
+	}
+	cmd, ok := ParseCommand(msg)
+	if !ok || cmd.Name != c.flow.cancel {
+		return false
+	}
+	return cmd.Mention == "" || (c.flow.username != "" && strings.EqualFold(cmd.Mention, c.flow.username))
+}
+
+// State returns the name of the current state.
+func (c *Conversation) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Deadline returns the time at which the current state times out, or the
+// zero time if it doesn't have a timeout.
+func (c *Conversation) Deadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+// SetState moves the conversation to the state called name, or ends it if
+// name is empty.
+// When called from a handler, or while a handler is running, the state is
+// entered once the handler returns, replacing the one it returns.
+// It panics if the state doesn't exist.
+func (c *Conversation) SetState(name string) {
+	if _, ok := c.flow.states[name]; !ok && name != "" && name != c.flow.initial {
+		panic(fmt.Errorf("echotron: unknown conversation state %q", name))
+	}
+
+	c.mu.Lock()
+	c.next, c.hasNext = name, true
+	c.mu.Unlock()
+
+	// If a handler is running, the state is applied when it releases c.run.
+	if c.run.TryLock() {
+		c.release()
+	}
+}
+
+// release enters the state requested with SetState, if any, and unlocks
+// c.run, which must be held.
+func (c *Conversation) release() {
+	for {
+		c.mu.Lock()
+		name, ok := c.next, c.hasNext
+		c.next, c.hasNext = "", false
+		c.mu.Unlock()
+
+		if ok {
+			// The state has been validated by SetState.
+			c.transition(name)
+		}
+		c.run.Unlock()
+
+		// A SetState called right before the unlock couldn't acquire c.run,
+		// so its state is applied here unless another goroutine holds it.
+		c.mu.Lock()
+		ok = c.hasNext
+		c.mu.Unlock()
+		if !ok || !c.run.TryLock() {
+			return
+		}
+	}
+}
+
+// Get returns the value stored in the conversation data for key.
+func (c *Conversation) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.data[key]
+	return v, ok
+}
+
+// Set stores value in the conversation data for key.
+// The data is cleared when the conversation ends.
+func (c *Conversation) Set(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = value
+}
+
+// Delete removes the value stored in the conversation data for key.
+func (c *Conversation) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+}
+
+// Stop stops the timer of the current state, the conversation doesn't time
+// out anymore.
+func (c *Conversation) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// MarshalBinary encodes the current state and data of the conversation.
+func (c *Conversation) MarshalBinary() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return json.Marshal(conversationState{
+		State:    c.state,
+		Data:     c.data,
+		Deadline: c.deadline,
+	})
+}
+
+// UnmarshalBinary restores the state and data encoded by MarshalBinary.
+// A state that no longer exists in the flow is replaced by the initial one,
+// and a state whose timeout expired while the conversation wasn't running
+// times out before UnmarshalBinary returns, so before the next update is
+// handled.
+func (c *Conversation) UnmarshalBinary(b []byte) error {
+	var s conversationState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	c.run.Lock()
+	defer c.release()
+
+	c.mu.Lock()
+	c.data = s.Data
+	if c.data == nil {
+		c.data = make(map[string]string)
+	}
+
+	state, ok := c.flow.states[s.State]
+	if !ok && s.State != c.flow.initial {
+		c.enter(c.flow.initial, time.Time{})
+		c.data = make(map[string]string)
+		c.mu.Unlock()
+		return nil
+	}
+
+	expired := !s.Deadline.IsZero() && !time.Now().Before(s.Deadline)
+	if expired {
+		c.enter(s.State, time.Time{})
+	} else {
+		c.enter(s.State, s.Deadline)
+	}
+	c.mu.Unlock()
+
+	if expired {
+		c.expire(state)
+	}
+	return nil
+}
+
+// transition moves the conversation to the state called name, or ends it if
+// name is empty.
+// It must be called with c.run held.
+func (c *Conversation) transition(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if name == "" {
+		name = c.flow.initial
+		c.data = make(map[string]string)
+	}
+
+	s, ok := c.flow.states[name]
+	if !ok && name != c.flow.initial {
+		return fmt.Errorf("echotron: unknown conversation state %q", name)
+	}
+
+	var deadline time.Time
+	if s.Timeout > 0 {
+		deadline = time.Now().Add(s.Timeout)
+	}
+	c.enter(name, deadline)
+	return nil
+}
+
+// enter sets the current state and arms its timer.
+// It must be called with c.mu held.
+func (c *Conversation) enter(name string, deadline time.Time) {
+	c.gen++
+	c.state = name
+	c.deadline = deadline
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if deadline.IsZero() || c.stopped {
+		return
+	}
+
+	gen := c.gen
+	c.timer = time.AfterFunc(time.Until(deadline), func() {
+		c.timeout(gen)
+	})
+}
+
+// timeout handles the expiration of the timer of the generation gen of the
+// current state, ignoring it if the conversation has moved on meanwhile, and
+// saves the new state in the SessionStore of the flow, if any.
+func (c *Conversation) timeout(gen uint64) {
+	c.run.Lock()
+	c.mu.Lock()
+	if gen != c.gen || c.stopped {
+		c.mu.Unlock()
+		c.release()
+		return
+	}
+	s := c.flow.states[c.state]
+	c.mu.Unlock()
+
+	// The state is saved after release, which applies the one requested
+	// with SetState from OnTimeout, if any.
+	func() {
+		defer c.release()
+		c.expire(s)
+	}()
+	if c.flow.store == nil {
+		return
+	}
+
+	state, err := c.MarshalBinary()
+	if err == nil {
+		err = c.flow.store.Save(c.ChatID, state)
+	}
+	if err != nil {
+		log.Println("echotron.Conversation", "SessionStore", err)
+	}
+}
+
+// expire calls the OnTimeout function of s, the current state, and moves the
+// conversation to the state it returns.
+// It must be called with c.run held.
+func (c *Conversation) expire(s ConversationState) {
+	var next string
+	if s.OnTimeout != nil {
+		next = s.OnTimeout(c)
+	}
+	if err := c.transition(next); err != nil {
+		log.Println("echotron.Conversation", "timeout", err)
+		c.transition("")
+	}
+}
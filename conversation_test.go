@@ -0,0 +1,285 @@
+package echotron
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func textUpdate(text string) *Update {
+	u := &Update{Message: &Message{Text: text, Chat: Chat{ID: 1}}}
+	if len(text) > 0 && text[0] == '/' {
+		u.Message.Entities = []*MessageEntity{{Type: BotCommandEntity, Length: len(text)}}
+	}
+	return u
+}
+
+func signupFlow(cancelled *int) *ConversationFlow {
+	f := NewConversationFlow("idle")
+	f.Handle("idle", ConversationState{
+		Handle: func(_ context.Context, c *Conversation, u *Update) string {
+			if u.Message.Text == "/signup" {
+				return "name"
+			}
+			return "idle"
+		},
+	})
+	f.Handle("name", ConversationState{
+		Handle: func(_ context.Context, c *Conversation, u *Update) string {
+			c.Set("name", u.Message.Text)
+			return "age"
+		},
+	})
+	f.Handle("age", ConversationState{
+		Handle: func(_ context.Context, c *Conversation, u *Update) string {
+			c.Set("age", u.Message.Text)
+			return "done"
+		},
+	})
+	f.Handle("done", ConversationState{
+		Handle: func(context.Context, *Conversation, *Update) string {
+			return ""
+		},
+	})
+	f.SetCancel("cancel", func(context.Context, *Conversation, *Update) {
+		*cancelled++
+	})
+	return f
+}
+
+func TestConversation(t *testing.T) {
+	var cancelled int
+	c := signupFlow(&cancelled).NewConversation(1)
+
+	for _, text := range []string{"hi", "/signup", "Alice", "30"} {
+		c.Update(textUpdate(text))
+	}
+	if c.State() != "done" {
+		t.Fatalf("expected state done, got %q", c.State())
+	}
+	if name, _ := c.Get("name"); name != "Alice" {
+		t.Fatalf("expected name Alice, got %q", name)
+	}
+
+	c.Update(textUpdate("ok"))
+	if _, ok := c.Get("name"); ok || c.State() != "idle" {
+		t.Fatalf("expected the conversation to end, got state %q", c.State())
+	}
+
+	c.Update(textUpdate("/signup"))
+	c.Update(textUpdate("/cancel"))
+	if c.State() != "idle" || cancelled != 1 {
+		t.Fatalf("expected the conversation to be cancelled, got state %q", c.State())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for an unknown state")
+		}
+	}()
+	c.SetState("missing")
+}
+
+func TestConversationPersistence(t *testing.T) {
+	flow := signupFlow(new(int))
+	c := flow.NewConversation(1)
+	c.Update(textUpdate("/signup"))
+	c.Update(textUpdate("Bob"))
+
+	state, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := flow.NewConversation(1)
+	if err := r.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := r.Get("name"); r.State() != "age" || name != "Bob" {
+		t.Fatalf("expected state age with name Bob, got %q and %q", r.State(), name)
+	}
+
+	if err := r.UnmarshalBinary([]byte(`{"state":"removed","data":{"k":"v"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get("k"); ok || r.State() != "idle" {
+		t.Fatalf("expected the initial state, got %q", r.State())
+	}
+}
+
+func TestConversationTimeout(t *testing.T) {
+	timedOut := make(chan string, 1)
+
+	f := NewConversationFlow("idle")
+	f.Handle("idle", ConversationState{
+		Handle: func(context.Context, *Conversation, *Update) string { return "waiting" },
+	})
+	f.Handle("waiting", ConversationState{
+		Handle:  func(context.Context, *Conversation, *Update) string { return "waiting" },
+		Timeout: 20 * time.Millisecond,
+		OnTimeout: func(c *Conversation) string {
+			timedOut <- c.State()
+			return ""
+		},
+	})
+
+	c := f.NewConversation(1)
+	c.Update(textUpdate("go"))
+	if c.Deadline().IsZero() {
+		t.Fatal("expected a deadline")
+	}
+
+	select {
+	case s := <-timedOut:
+		if s != "waiting" {
+			t.Fatalf("expected timeout in state waiting, got %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout not fired")
+	}
+	waitFor(t, func() bool { return c.State() == "idle" })
+
+	// An expired deadline restored from the store fires right away.
+	r := f.NewConversation(1)
+	r.UnmarshalBinary([]byte(`{"state":"waiting","deadline":"2000-01-01T00:00:00Z"}`))
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Fatal("restored timeout not fired")
+	}
+
+	// Stopped conversations don't time out.
+	s := f.NewConversation(1)
+	s.Update(textUpdate("go"))
+	s.Stop()
+	select {
+	case <-timedOut:
+		t.Fatal("unexpected timeout after Stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConversationSetStateFromHandler(t *testing.T) {
+	timedOut := make(chan struct{})
+
+	f := NewConversationFlow("idle")
+	f.Handle("idle", ConversationState{
+		Handle: func(_ context.Context, c *Conversation, _ *Update) string {
+			c.SetState("waiting")
+			return "idle"
+		},
+	})
+	f.Handle("waiting", ConversationState{
+		Handle:  func(context.Context, *Conversation, *Update) string { return "waiting" },
+		Timeout: 10 * time.Millisecond,
+		OnTimeout: func(c *Conversation) string {
+			c.SetState("done")
+			close(timedOut)
+			return ""
+		},
+	})
+	f.Handle("done", ConversationState{})
+
+	c := f.NewConversation(1)
+	done := make(chan struct{})
+	go func() {
+		c.Update(textUpdate("go"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetState deadlocked in a handler")
+	}
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Fatal("SetState deadlocked in OnTimeout")
+	}
+	waitFor(t, func() bool { return c.State() == "done" })
+}
+
+func TestConversationCancelMention(t *testing.T) {
+	var cancelled int
+	flow := signupFlow(&cancelled)
+	c := flow.NewConversation(1)
+
+	c.Update(textUpdate("/signup"))
+	c.Update(textUpdate("/cancel@OtherBot"))
+	if cancelled != 0 {
+		t.Fatal("cancelled by a command addressed to another bot")
+	}
+
+	flow.SetUsername("@ExampleBot")
+	c.SetState("name")
+	c.Update(textUpdate("/cancel@examplebot"))
+	if cancelled != 1 || c.State() != "idle" {
+		t.Fatalf("expected the conversation to be cancelled, got state %q", c.State())
+	}
+}
+
+func TestConversationExpiredRestore(t *testing.T) {
+	var timeouts int
+
+	f := NewConversationFlow("idle")
+	f.Handle("idle", ConversationState{
+		Handle: func(context.Context, *Conversation, *Update) string { return "idle" },
+	})
+	f.Handle("waiting", ConversationState{
+		Handle: func(context.Context, *Conversation, *Update) string {
+			t.Error("update handled in the expired state")
+			return "waiting"
+		},
+		Timeout: time.Minute,
+		OnTimeout: func(*Conversation) string {
+			timeouts++
+			return ""
+		},
+	})
+
+	c := f.NewConversation(1)
+	if err := c.UnmarshalBinary([]byte(`{"state":"waiting","deadline":"2000-01-01T00:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if timeouts != 1 || c.State() != "idle" {
+		t.Fatalf("expected the state to time out on restore, got %d timeouts in state %q", timeouts, c.State())
+	}
+	c.Update(textUpdate("hi"))
+}
+
+func TestConversationTimeoutSaved(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewConversationFlow("idle")
+	f.Handle("idle", ConversationState{
+		Handle: func(context.Context, *Conversation, *Update) string { return "waiting" },
+	})
+	f.Handle("waiting", ConversationState{Timeout: 10 * time.Millisecond})
+	f.SetSessionStore(store)
+
+	c := f.NewConversation(1)
+	c.Update(textUpdate("go"))
+
+	waitFor(t, func() bool {
+		state, _ := store.Load(1)
+		r := f.NewConversation(1)
+		return state != nil && r.UnmarshalBinary(state) == nil && r.State() == "idle"
+	})
+}
+
+func TestConversationCancelNormalized(t *testing.T) {
+	var cancelled int
+	flow := signupFlow(&cancelled)
+	flow.SetCancel("/Cancel", func(context.Context, *Conversation, *Update) { cancelled++ })
+
+	c := flow.NewConversation(1)
+	c.Update(textUpdate("/signup"))
+	c.Update(textUpdate("/cancel"))
+	if cancelled != 1 || c.State() != "idle" {
+		t.Fatalf("expected the conversation to be cancelled, got state %q", c.State())
+	}
+}
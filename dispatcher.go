@@ -20,12 +20,20 @@ package echotron
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Bot is the interface that must be implemented by your definition of
@@ -35,6 +43,25 @@ type Bot interface {
 	Update(*Update)
 }
 
+// Starter is an optional interface for Bot.
+// If a Bot implements it, the Dispatcher calls Start exactly once when the
+// session is created, right after NewBotFn and before the first call to Update.
+// Start is called synchronously, so it should launch any long running task
+// in its own goroutine.
+type Starter interface {
+	Start()
+}
+
+// Stopper is an optional interface for Bot.
+// If a Bot implements it, the Dispatcher calls Stop exactly once when the
+// session is removed, be it with DelSession, because AddSession replaced it
+// or because the Dispatcher has been shut down.
+// Stop is the place where to release goroutines, tickers and open files
+// owned by the Bot.
+type Stopper interface {
+	Stop()
+}
+
 // NewBotFn is called every time echotron receives an update with a chat ID never
 // encountered before.
 type NewBotFn func(chatId int64) Bot
@@ -43,11 +70,35 @@ type NewBotFn func(chatId int64) Bot
 // associated with each chatID. When a new chat ID is found, the provided function
 // of type NewBotFn will be called.
 type Dispatcher struct {
-	api        API
-	newBot     NewBotFn
-	updates    chan *Update
-	httpServer *http.Server
-	sessions   smap[int64, Bot]
+	api          API
+	newBot       NewBotFn
+	albums       *mediaGroups
+	global       Bot
+	subscribers  []UpdateSubscriber
+	journal      UpdateJournal
+	middlewares  []Middleware
+	modec        chan Mode
+	store        SessionStore
+	mode         int32
+	ring         hashRing
+	updates      chan *Update
+	httpServer   *http.Server
+	secretToken  string
+	replyTimeout time.Duration
+	sessions     smap[int64, Bot]
+	offsets      offsetTracker
+	recent       dedup
+	queue        chan *Update
+	workers      int
+	queueSize    int
+	policy       OverflowPolicy
+	active       int64
+	dropped      uint64
+	rejected     uint64
+	errHandler   func(error)
+	startOnce    sync.Once
+	mu           sync.RWMutex
+	closed       bool
 }
 
 // NewDispatcher returns a new instance of the Dispatcher object.
@@ -65,13 +116,75 @@ func NewDispatcher(token string, newBotFn NewBotFn) *Dispatcher {
 
 // DelSession deletes the Bot instance, seen as a session, from the
 // map with all of them.
+// If the Bot implements Stopper, its Stop method is called.
 func (d *Dispatcher) DelSession(chatID int64) {
-	d.sessions.delete(chatID)
+	if bot, ok := d.sessions.loadAndDelete(chatID); ok {
+		stopBot(bot)
+	}
 }
 
 // AddSession allows to arbitrarily create a new Bot instance.
+// If a session for chatID already exists, it is replaced and stopped.
+// It does nothing if the Dispatcher has no NewBotFn, as it happens for the
+// front-end returned by NewShardedDispatcher, or if it returns nil.
 func (d *Dispatcher) AddSession(chatID int64) {
-	d.sessions.store(chatID, d.newBot(chatID))
+	bot := d.create(chatID)
+	if bot == nil {
+		return
+	}
+	startBot(bot)
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		stopBot(bot)
+		return
+	}
+	old, replaced := d.sessions.loadAndDelete(chatID)
+	d.sessions.store(chatID, bot)
+	d.mu.Unlock()
+
+	if replaced {
+		stopBot(old)
+	}
+}
+
+// Shutdown removes all the sessions from the Dispatcher, calling Stop on those
+// implementing Stopper.
+// The albums being collected, if any, are delivered first.
+// After Shutdown no new session will be created and the updates still to be
+// delivered are discarded, but left pending in the OffsetStore and in the
+// UpdateJournal so that they're processed again after a restart.
+func (d *Dispatcher) Shutdown() {
+	if d.albums != nil {
+		d.albums.deliverAll()
+	}
+
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.sessions.rangeAll(func(chatID int64, _ Bot) bool {
+		d.DelSession(chatID)
+		return true
+	})
+
+	if d.global != nil {
+		stopBot(d.global)
+	}
+}
+
+// SetGlobalBot sets the Bot that receives the updates not coming from a chat:
+// inline queries, chosen inline results, callback queries from inline messages,
+// polls and purchased paid media.
+// Without a global Bot, those updates are delivered to the session of the user
+// who sent them, or discarded if they have no sender, like polls.
+// If b implements Starter, Start is called right away, and if it implements
+// Stopper, Stop is called on Shutdown.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) SetGlobalBot(b Bot) {
+	d.global = b
+	startBot(b)
 }
 
 // Poll is a wrapper function for PollOptions.
@@ -81,34 +194,89 @@ func (d *Dispatcher) Poll() error {
 
 // PollOptions starts the polling loop so that the dispatcher calls the function Update
 // upon receiving any update from Telegram.
+// PollOptions only returns on fatal errors, see PollContext for the details.
 func (d *Dispatcher) PollOptions(dropPendingUpdates bool, opts UpdateOptions) error {
+	return d.PollContext(context.Background(), dropPendingUpdates, opts)
+}
+
+// PollContext is like PollOptions but it stops as soon as ctx is done.
+// Transient errors, like network failures or Telegram being unavailable,
+// are retried with an exponential backoff without losing the offset of the
+// updates already received.
+// PollContext returns only when ctx is done or on errors that can't be solved
+// by retrying, such as an invalid token or a conflict with another bot
+// instance receiving the updates.
+// If opts.OffsetStore is set, the ID of the last update whose Update call has
+// returned is saved in it, and polling resumes from the saved offset without
+// dropping the pending updates.
+func (d *Dispatcher) PollContext(ctx context.Context, dropPendingUpdates bool, opts UpdateOptions) error {
 	var (
+		bo         backoff
+		store      = opts.OffsetStore
 		timeout    = opts.Timeout
 		isFirstRun = true
 	)
 
+	if store != nil {
+		offset, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			opts.Offset = offset + 1
+			dropPendingUpdates = false
+		}
+		d.offsets.track(store)
+	}
+
+	if len(opts.AllowedUpdates) == 0 {
+		opts.AllowedUpdates = d.AllowedUpdates()
+	}
+
 	// deletes webhook if present to run in long polling mode
-	if _, err := d.api.DeleteWebhook(dropPendingUpdates); err != nil {
-		return err
+	for {
+		_, err := d.api.DeleteWebhook(dropPendingUpdates)
+		if err == nil {
+			break
+		}
+		log.Println("echotron.Dispatcher", "PollContext", err)
+		if err := bo.retry(ctx, err); err != nil {
+			return err
+		}
 	}
+	bo.reset()
 
 	for {
 		if isFirstRun {
 			opts.Timeout = 0
 		}
 
-		response, err := d.api.GetUpdates(&opts)
+		response, err := d.api.getUpdates(ctx, &opts)
 		if err != nil {
-			return err
+			log.Println("echotron.Dispatcher", "PollContext", err)
+			if err := bo.retry(ctx, err); err != nil {
+				return err
+			}
+			continue
 		}
+		bo.reset()
 
+		l := len(response.Result)
 		if !dropPendingUpdates || !isFirstRun {
 			for _, u := range response.Result {
-				d.updates <- u
+				d.offsets.add(u.ID)
+				if err := d.push(ctx, u, false); err != nil {
+					return err
+				}
+			}
+		} else if store != nil && l > 0 {
+			// The dropped updates must not be replayed after a restart.
+			if err := store.Save(response.Result[l-1].ID); err != nil {
+				log.Println("echotron.Dispatcher", "PollContext", err)
 			}
 		}
 
-		if l := len(response.Result); l > 0 {
+		if l > 0 {
 			opts.Offset = response.Result[l-1].ID + 1
 		}
 
@@ -119,19 +287,159 @@ func (d *Dispatcher) PollOptions(dropPendingUpdates bool, opts UpdateOptions) er
 	}
 }
 
-func (d *Dispatcher) instance(chatID int64) Bot {
-	bot, ok := d.sessions.load(chatID)
-	if !ok {
-		bot = d.newBot(chatID)
-		d.sessions.store(chatID, bot)
+// route returns the Bot the update must be delivered to, or nil if there's none.
+// After Shutdown it returns errDispatcherClosed, unless the update goes to a
+// shard.
+func (d *Dispatcher) route(update *Update) (Bot, error) {
+	switch {
+	case d.ring.shards != nil:
+		key, ok := update.ChatID()
+		if !ok {
+			key = int64(update.ID)
+		}
+		return d.ring.get(key), nil
+
+	case d.isClosed():
+		return nil, errDispatcherClosed
+
+	case d.global != nil && update.chatless():
+		return d.global, nil
+	}
+
+	if chatID, ok := update.ChatID(); ok {
+		return d.instance(chatID)
+	}
+	return nil, nil
+}
+
+// sessionKey returns the chat ID of the session the update is delivered to,
+// and false if it's delivered to a shard or to the global Bot.
+func (d *Dispatcher) sessionKey(update *Update) (int64, bool) {
+	if d.ring.shards != nil || (d.global != nil && update.chatless()) {
+		return 0, false
+	}
+	return update.ChatID()
+}
+
+// chatless reports whether the update doesn't come from a chat.
+func (u Update) chatless() bool {
+	if _, ok := u.ChatID(); !ok {
+		return true
 	}
-	return bot
+
+	return u.InlineQuery != nil ||
+		u.ChosenInlineResult != nil ||
+		u.PurchasedPaidMedia != nil ||
+		(u.CallbackQuery != nil && u.CallbackQuery.Message == nil)
 }
 
+// instance returns the Bot associated with chatID, creating and starting it
+// if needed. It returns nil if the Dispatcher has no NewBotFn,
+// errDispatcherClosed if it has been shut down, and an error if the saved
+// state of the session can't be restored.
+func (d *Dispatcher) instance(chatID int64) (Bot, error) {
+	if bot, ok := d.sessions.load(chatID); ok {
+		return bot, nil
+	}
+
+	bot := d.create(chatID)
+	if bot == nil {
+		return nil, nil
+	}
+	if err := d.restore(chatID, bot); err != nil {
+		return nil, err
+	}
+	startBot(bot)
+
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		stopBot(bot)
+		return nil, errDispatcherClosed
+	}
+	actual, loaded := d.sessions.loadOrStore(chatID, bot)
+	d.mu.RUnlock()
+
+	// Another goroutine created the session in the meantime, so this
+	// instance is discarded.
+	if loaded {
+		stopBot(bot)
+	}
+	return actual, nil
+}
+
+// create returns a new Bot for the session of chatID, or nil if the
+// Dispatcher has no NewBotFn.
+func (d *Dispatcher) create(chatID int64) Bot {
+	if d.newBot == nil {
+		return nil
+	}
+	return d.newBot(chatID)
+}
+
+// listen moves the updates sent to the updates channel into the queue.
 func (d *Dispatcher) listen() {
 	for update := range d.updates {
-		bot := d.instance(update.ChatID())
-		go bot.Update(update)
+		d.push(context.Background(), update, false)
+	}
+}
+
+// run passes the update through the middlewares to its Bot, if any, and then
+// marks it as processed.
+func (d *Dispatcher) run(update *Update) {
+	atomic.AddInt64(&d.active, 1)
+	defer atomic.AddInt64(&d.active, -1)
+
+	var held bool
+	d.handle(context.WithValue(context.Background(), holdKey{}, &held), update, d.deliver)
+	if !held {
+		d.complete(update)
+	}
+}
+
+// holdKey is the context key of the flag set when the completion of an update
+// is postponed.
+type holdKey struct{}
+
+// postpone tells run not to complete the update processed with ctx, either
+// because it's completed later or because it must stay pending.
+// It reports whether ctx allows it.
+func postpone(ctx context.Context) bool {
+	held, ok := ctx.Value(holdKey{}).(*bool)
+	if ok {
+		*held = true
+	}
+	return ok
+}
+
+// complete is called once the update has been fully processed.
+func (d *Dispatcher) complete(update *Update) {
+	if err := d.offsets.complete(update.ID); err != nil {
+		log.Println("echotron.Dispatcher", "OffsetStore", err)
+	}
+	d.ack(update)
+}
+
+// ack removes the update from the journal, if any.
+func (d *Dispatcher) ack(update *Update) {
+	if d.journal == nil {
+		return
+	}
+
+	if err := d.journal.Ack(update.ID); err != nil {
+		log.Println("echotron.Dispatcher", "UpdateJournal", err)
+	}
+}
+
+func startBot(b Bot) {
+	if s, ok := unwrapBot(b).(Starter); ok {
+		s.Start()
+	}
+}
+
+func stopBot(b Bot) {
+	if s, ok := unwrapBot(b).(Stopper); ok {
+		s.Stop()
 	}
 }
 
@@ -151,11 +459,16 @@ func (d *Dispatcher) ListenWebhookOptions(webhookURL string, dropPendingUpdates
 		return err
 	}
 
+	opts = d.webhookOptions(opts)
 	whURL := fmt.Sprintf("%s%s", u.Hostname(), u.EscapedPath())
 	if _, err = d.api.SetWebhook(whURL, dropPendingUpdates, opts); err != nil {
 		return err
 	}
 
+	if opts != nil {
+		d.SetSecretToken(opts.SecretToken)
+	}
+
 	if d.httpServer != nil {
 		mux := http.NewServeMux()
 		mux.Handle("/", d.httpServer.Handler)
@@ -167,30 +480,288 @@ func (d *Dispatcher) ListenWebhookOptions(webhookURL string, dropPendingUpdates
 	return http.ListenAndServe(fmt.Sprintf(":%s", u.Port()), nil)
 }
 
-// SetHTTPServer allows to set a custom http.Server for ListenWebhook and ListenWebhookOptions.
+// ListenWebhookTLS is like ListenWebhookOptions but it serves the webhook over
+// HTTPS by itself, with no need for a reverse proxy.
+// The certificate and its key are read from certFile and keyFile, or, if both
+// are empty, a self-signed certificate for the host of webhookURL is generated.
+// Self-signed certificates are uploaded to Telegram with SetWebhook, unless
+// opts.Certificate is already set.
+// Since the server is reached directly, the webhook url communicated to Telegram
+// keeps the port, which must be one of 443, 80, 88 or 8443.
+func (d *Dispatcher) ListenWebhookTLS(webhookURL, certFile, keyFile string, dropPendingUpdates bool, opts *WebhookOptions) error {
+	var (
+		certPEM []byte
+		keyPEM  []byte
+		whOpts  WebhookOptions
+	)
+
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	if !webhookPorts[port] {
+		return fmt.Errorf("echotron: port %s not supported for webhooks, use one of 443, 80, 88 or 8443", port)
+	}
+
+	if certFile == "" && keyFile == "" {
+		certPEM, keyPEM, err = NewSelfSignedCert(u.Hostname())
+	} else if certPEM, err = os.ReadFile(certFile); err == nil {
+		keyPEM, err = os.ReadFile(keyFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	if opts = d.webhookOptions(opts); opts != nil {
+		whOpts = *opts
+	}
+
+	selfSigned, err := isSelfSigned(certPEM)
+	if err != nil {
+		return err
+	}
+	if selfSigned && whOpts.Certificate.path == "" {
+		whOpts.Certificate = NewInputFileBytes("cert.pem", certPEM)
+	}
+
+	whURL := fmt.Sprintf("https://%s:%s%s", u.Hostname(), port, u.EscapedPath())
+	if _, err = d.api.SetWebhook(whURL, dropPendingUpdates, &whOpts); err != nil {
+		return err
+	}
+	d.SetSecretToken(whOpts.SecretToken)
+
+	mux := http.NewServeMux()
+	srv := d.httpServer
+	if srv == nil {
+		srv = &http.Server{Addr: fmt.Sprintf(":%s", port)}
+	} else if srv.Handler != nil {
+		mux.Handle("/", srv.Handler)
+	}
+	mux.HandleFunc(u.EscapedPath(), d.HandleWebhook)
+	srv.Handler = mux
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// webhookPorts contains the ports Telegram can send webhook updates to.
+var webhookPorts = map[string]bool{
+	"443":  true,
+	"80":   true,
+	"88":   true,
+	"8443": true,
+}
+
+// SetHTTPServer allows to set a custom http.Server for ListenWebhook, ListenWebhookOptions
+// and ListenWebhookTLS.
 func (d *Dispatcher) SetHTTPServer(s *http.Server) {
 	d.httpServer = s
 }
 
+// SetSecretToken sets the secret token that HandleWebhook expects in the
+// X-Telegram-Bot-Api-Secret-Token header of each request.
+// ListenWebhookOptions sets it automatically from WebhookOptions.SecretToken,
+// so it's only needed when HandleWebhook is mounted on your own server.
+// It's safe to call while the Dispatcher is receiving updates.
+func (d *Dispatcher) SetSecretToken(token string) {
+	d.mu.Lock()
+	d.secretToken = token
+	d.mu.Unlock()
+}
+
+// secret returns the secret token set with SetSecretToken.
+func (d *Dispatcher) secret() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.secretToken
+}
+
 // HandleWebhook is the http.HandlerFunc for the webhook URL.
 // Useful if you've already a http server running and want to handle the request yourself.
+// Requests that don't use the POST method, that don't carry the secret token
+// set with SetSecretToken or that exceed the maximum body size are rejected
+// with the appropriate 4xx status code, while a 503 status code is returned
+// after the Dispatcher has been shut down so that Telegram retries later.
 func (d *Dispatcher) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	var update Update
+	d.handleWebhook(w, r, d.secret())
+}
 
-	jsn, err := readRequest(r)
+// handleWebhook is HandleWebhook with the secret token the requests must carry.
+func (d *Dispatcher) handleWebhook(w http.ResponseWriter, r *http.Request, secretToken string) {
+	update, code, err := readUpdate(w, r, secretToken)
 	if err != nil {
 		log.Println("echotron.Dispatcher", "HandleWebhook", err)
+		http.Error(w, http.StatusText(code), code)
 		return
 	}
 
-	if err := json.Unmarshal(jsn, &update); err != nil {
+	if d.isClosed() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Telegram delivers the same update again if it isn't acknowledged in time.
+	if d.recent.seen(update.ID) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if d.replyTimeout > 0 {
+		d.reply(w, r, update)
+		return
+	}
+
+	if d.journal != nil {
+		if err := d.journal.Append(update); err != nil {
+			d.recent.forget(update.ID)
+			log.Println("echotron.Dispatcher", "UpdateJournal", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := d.push(r.Context(), update, true); err != nil {
+		d.recent.forget(update.ID)
+		d.ack(update)
 		log.Println("echotron.Dispatcher", "HandleWebhook", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	d.updates <- &update
+// SetWebhookReply enables the synchronous webhook mode, in which HandleWebhook
+// processes each update right away, waiting up to timeout for the Bots
+// implementing WebhookReplier to process it, and sends the WebhookReply they
+// return in the body of the response.
+// If a Bot takes longer than timeout, the webhook request is answered right
+// away and the reply is performed as a regular API call once it's ready.
+// In this mode the updates don't go through the queue set with SetQueue.
+// A timeout of 0, which is the default, disables the synchronous mode.
+func (d *Dispatcher) SetWebhookReply(timeout time.Duration) {
+	d.replyTimeout = timeout
 }
 
+// reply processes update synchronously and answers the webhook request with the
+// reply of its Bot, falling back to a regular API call if the Bot doesn't reply
+// in time.
+func (d *Dispatcher) reply(w http.ResponseWriter, r *http.Request, update *Update) {
+	var (
+		replyc = make(chan *WebhookReply)
+		done   = make(chan struct{})
+		late   = make(chan struct{})
+		timer  = time.NewTimer(d.replyTimeout)
+	)
+	defer timer.Stop()
+
+	go func() {
+		defer close(done)
+		defer d.complete(update)
+
+		d.handle(context.Background(), update, func(ctx context.Context, u *Update) {
+			err := d.process(u, func(bot Bot) error {
+				replier, ok := unwrapBot(bot).(WebhookReplier)
+				if !ok {
+					return callBot(ctx, bot, u)
+				}
+
+				reply := replier.UpdateReply(u)
+				select {
+				case replyc <- reply:
+					return nil
+				case <-late:
+					if reply == nil {
+						return nil
+					}
+					return reply.call(d.api)
+				}
+			})
+			if err != nil {
+				d.handleError(err)
+			}
+		})
+	}()
+
+	select {
+	case reply := <-replyc:
+		if reply == nil {
+			w.WriteHeader(http.StatusOK)
+		} else if err := reply.write(w); err != nil {
+			log.Println("echotron.Dispatcher", "WebhookReply", err)
+		}
+
+	case <-done:
+		w.WriteHeader(http.StatusOK)
+
+	case <-timer.C:
+		close(late)
+		w.WriteHeader(http.StatusOK)
+
+	case <-r.Context().Done():
+		close(late)
+	}
+}
+
+// errDispatcherClosed is returned when an update can't be processed because
+// the Dispatcher has been shut down.
+var errDispatcherClosed = errors.New("echotron: dispatcher closed")
+
+func (d *Dispatcher) isClosed() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.closed
+}
+
+// secretTokenHeader is the header carrying the secret token of the webhook.
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// maxUpdateSize is the maximum size in bytes of an update received via webhook.
+const maxUpdateSize = 1 << 20
+
+// readUpdate validates a webhook request and decodes the update it carries.
+// On failure it also returns the HTTP status code to respond with.
+func readUpdate(w http.ResponseWriter, r *http.Request, secretToken string) (*Update, int, error) {
+	var update Update
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("unexpected method %s", r.Method)
+	}
+
+	if secretToken != "" {
+		tok := r.Header.Get(secretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(secretToken)) != 1 {
+			return nil, http.StatusUnauthorized, errors.New("invalid secret token")
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpdateSize)
+	jsn, err := readRequest(r)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) || errors.Is(err, errUpdateTooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := json.Unmarshal(jsn, &update); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return &update, http.StatusOK, nil
+}
+
+var errUpdateTooLarge = errors.New("update too large")
+
 func readRequest(r *http.Request) ([]byte, error) {
 	switch r.Header.Get("Content-Encoding") {
 	case "gzip":
@@ -199,7 +770,13 @@ func readRequest(r *http.Request) ([]byte, error) {
 			return []byte{}, err
 		}
 		defer reader.Close()
-		return io.ReadAll(reader)
+
+		// Limit the decompressed size as well as the compressed one.
+		b, err := io.ReadAll(io.LimitReader(reader, maxUpdateSize+1))
+		if err == nil && len(b) > maxUpdateSize {
+			err = errUpdateTooLarge
+		}
+		return b, err
 
 	default:
 		return io.ReadAll(r.Body)
@@ -1,6 +1,15 @@
 package echotron
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -9,6 +18,28 @@ type test struct{}
 
 func (t test) Update(_ *Update) {}
 
+type botFunc func(*Update)
+
+func (b botFunc) Update(u *Update) { b(u) }
+
+// fakeAPI returns an API object whose requests are answered by handler,
+// which receives the name of the called method.
+func fakeAPI(t *testing.T, handler func(method string, r *http.Request) string) API {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, handler(path.Base(r.URL.Path), r))
+	}))
+	t.Cleanup(srv.Close)
+	return CustomAPI(srv.URL+"/", "token")
+}
+
+func fastRetries(t *testing.T) {
+	minDelay, maxDelay := minRetryDelay, maxRetryDelay
+	minRetryDelay, maxRetryDelay = time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() {
+		minRetryDelay, maxRetryDelay = minDelay, maxDelay
+	})
+}
+
 var dsp *Dispatcher
 
 func TestNewDispatcher(t *testing.T) {
@@ -173,3 +204,276 @@ func TestPoll(_ *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+type lifecycleBot struct {
+	starts *int32
+	stops  *int32
+}
+
+func (l lifecycleBot) Update(_ *Update) {}
+func (l lifecycleBot) Start()           { atomic.AddInt32(l.starts, 1) }
+func (l lifecycleBot) Stop()            { atomic.AddInt32(l.stops, 1) }
+
+func TestLifecycle(t *testing.T) {
+	var starts, stops int32
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return lifecycleBot{&starts, &stops}
+	})
+
+	d.AddSession(1)
+	d.AddSession(1)
+	d.instance(2)
+	d.instance(2)
+	d.DelSession(2)
+	d.DelSession(2)
+
+	if starts != 3 || stops != 2 {
+		t.Fatalf("expected 3 starts and 2 stops, got %d and %d", starts, stops)
+	}
+
+	d.Shutdown()
+	if stops != 3 {
+		t.Fatalf("expected 3 stops after shutdown, got %d", stops)
+	}
+
+	if bot, _ := d.instance(3); bot != nil {
+		t.Fatal("expected no session after shutdown")
+	}
+	if starts != stops {
+		t.Fatalf("expected every started bot to be stopped, got %d starts and %d stops", starts, stops)
+	}
+}
+
+func TestPollContextRetry(t *testing.T) {
+	var offsets []string
+
+	fastRetries(t)
+	received := make(chan *Update, 1)
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) { received <- u })
+	})
+	d.api = fakeAPI(t, func(method string, r *http.Request) string {
+		if method != "getUpdates" {
+			return `{"ok":true}`
+		}
+
+		offsets = append(offsets, r.URL.Query().Get("offset"))
+		switch len(offsets) {
+		case 1:
+			return `{"ok":true,"result":[{"update_id":10,"message":{"chat":{"id":1}}}]}`
+		case 2:
+			return `{"ok":false,"error_code":502,"description":"Bad Gateway"}`
+		case 3:
+			return `{"ok":true,"result":[]}`
+		default:
+			return `{"ok":false,"error_code":409,"description":"Conflict"}`
+		}
+	})
+
+	var apiErr *APIError
+	if err := d.PollOptions(false, UpdateOptions{}); !errors.As(err, &apiErr) || apiErr.ErrorCode() != 409 {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+
+	if u := <-received; u.ID != 10 {
+		t.Fatalf("expected update 10, got %d", u.ID)
+	}
+
+	if expected := []string{"", "11", "11", "11"}; !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets)
+	}
+}
+
+func TestPollContextCancel(t *testing.T) {
+	fastRetries(t)
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	d.api = fakeAPI(t, func(_ string, _ *http.Request) string {
+		return `{"ok":false,"error_code":500,"description":"Internal Server Error"}`
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := d.PollContext(ctx, true, UpdateOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+}
+
+func TestPollContextOffsetStore(t *testing.T) {
+	var (
+		offsets []string
+		store   = &memOffsetStore{saved: []int{41}}
+		done    = make(chan struct{})
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) {
+			if u.ID == 43 {
+				close(done)
+			}
+		})
+	})
+	d.api = fakeAPI(t, func(method string, r *http.Request) string {
+		switch method {
+		case "deleteWebhook":
+			if r.URL.Query().Get("drop_pending_updates") != "false" {
+				t.Error("pending updates dropped while resuming")
+			}
+			return `{"ok":true}`
+
+		case "getUpdates":
+			offsets = append(offsets, r.URL.Query().Get("offset"))
+			if len(offsets) == 1 {
+				return `{"ok":true,"result":[{"update_id":42,"message":{"chat":{"id":1}}},{"update_id":43,"message":{"chat":{"id":2}}}]}`
+			}
+			<-done
+			return `{"ok":false,"error_code":401,"description":"Unauthorized"}`
+		}
+		return `{"ok":true}`
+	})
+
+	d.PollOptions(true, UpdateOptions{OffsetStore: store})
+
+	if offsets[0] != "42" {
+		t.Fatalf("expected to resume from offset 42, got %s", offsets[0])
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if offset, _ := store.Load(); offset != 43 {
+		t.Fatalf("expected offset 43 to be saved, got %d", offset)
+	}
+}
+
+func TestHandleWebhook(t *testing.T) {
+	received := make(chan *Update, 2)
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) { received <- u })
+	})
+	d.SetSecretToken("secret")
+
+	tests := []struct {
+		method string
+		secret string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "secret", `{"update_id":1}`, http.StatusMethodNotAllowed},
+		{http.MethodPost, "wrong", `{"update_id":1}`, http.StatusUnauthorized},
+		{http.MethodPost, "secret", `{"update_id":`, http.StatusBadRequest},
+		{http.MethodPost, "secret", strings.Repeat(" ", maxUpdateSize+1), http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "secret", `{"update_id":1,"message":{"chat":{"id":1}}}`, http.StatusOK},
+		{http.MethodPost, "secret", `{"update_id":1,"message":{"chat":{"id":1}}}`, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", tt.secret)
+		rec := httptest.NewRecorder()
+
+		d.HandleWebhook(rec, req)
+		if rec.Code != tt.code {
+			t.Fatalf("test #%d: expected status %d, got %d", i, tt.code, rec.Code)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if l := len(received); l != 1 {
+		t.Fatalf("expected the update to be delivered once, got %d", l)
+	}
+
+	d.Shutdown()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":2}`))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "secret")
+	rec := httptest.NewRecorder()
+	if d.HandleWebhook(rec, req); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 after shutdown, got %d", rec.Code)
+	}
+}
+
+func TestListenWebhookTLS(t *testing.T) {
+	var (
+		whURL = make(chan string, 1)
+		cert  = make(chan bool, 1)
+		srv   = &http.Server{Addr: "127.0.0.1:0"}
+		errc  = make(chan error, 1)
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	d.SetHTTPServer(srv)
+	d.api = fakeAPI(t, func(_ string, r *http.Request) string {
+		_, _, err := r.FormFile("certificate")
+		cert <- err == nil
+		whURL <- r.URL.Query().Get("url")
+		return `{"ok":true}`
+	})
+
+	if err := d.ListenWebhookTLS("https://127.0.0.1:1234/hook", "", "", false, nil); err == nil {
+		t.Fatal("expected error for unsupported port")
+	}
+
+	go func() {
+		errc <- d.ListenWebhookTLS("https://127.0.0.1:8443/hook", "", "", false, nil)
+	}()
+
+	if u := <-whURL; u != "https://127.0.0.1:8443/hook" {
+		t.Fatalf("unexpected webhook url %s", u)
+	}
+	if !<-cert {
+		t.Fatal("self-signed certificate not uploaded")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	srv.Close()
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("expected server closed error, got %v", err)
+	}
+}
+
+func TestGlobalBot(t *testing.T) {
+	var (
+		sessions = make(chan int64, 10)
+		global   = make(chan int, 10)
+	)
+
+	d := NewDispatcher("token", func(chatID int64) Bot {
+		sessions <- chatID
+		return test{}
+	})
+
+	updates := []*Update{
+		{ID: 1, InlineQuery: &InlineQuery{From: &User{ID: 10}}},
+		{ID: 2, CallbackQuery: &CallbackQuery{From: &User{ID: 10}, InlineMessageID: "x"}},
+		{ID: 3, Poll: &Poll{}},
+	}
+
+	// Without a global bot, polls are discarded and the rest go to the sender.
+	for _, u := range updates {
+		if b, _ := d.route(u); b == nil && u.Poll == nil {
+			t.Fatalf("update %d: expected a session", u.ID)
+		}
+	}
+	if n := len(sessions); n != 1 {
+		t.Fatalf("expected 1 session, got %d", n)
+	}
+	if _, ok := d.sessions.load(0); ok {
+		t.Fatal("unexpected session for chat 0")
+	}
+
+	d.SetGlobalBot(botFunc(func(u *Update) { global <- u.ID }))
+	for _, u := range updates {
+		d.run(u)
+	}
+	msg := &Update{ID: 4, Message: &Message{Chat: Chat{ID: 20}}}
+	d.run(msg)
+
+	if n := len(global); n != 3 {
+		t.Fatalf("expected 3 updates to the global bot, got %d", n)
+	}
+	if id := <-sessions; id != 10 {
+		t.Fatalf("expected session for chat 10, got %d", id)
+	}
+	if id := <-sessions; id != 20 {
+		t.Fatalf("expected session for chat 20, got %d", id)
+	}
+}
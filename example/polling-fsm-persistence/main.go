@@ -155,10 +155,7 @@ func main() {
 	go handleSignals()
 
 	dsp := echotron.NewDispatcher(token, newBot)
-	for {
-		// Poll blocks until a network error occurs, then returns it.
-		// Sleeping before retrying avoids hammering the API on transient failures.
-		log.Println(dsp.Poll())
-		time.Sleep(5 * time.Second)
-	}
+	// Poll retries transient failures on its own with an exponential backoff
+	// and only returns on fatal errors, such as an invalid token.
+	log.Fatalln(dsp.Poll())
 }
@@ -7,7 +7,6 @@ package main
 import (
 	"log"
 	"os"
-	"time"
 
 	"github.com/NicoNex/echotron/v3"
 )
@@ -61,15 +60,12 @@ func (b *bot) Update(update *echotron.Update) {
 
 func main() {
 	dsp := echotron.NewDispatcher(token, newBot)
-	for {
-		// PollOptions blocks until a network error occurs, then returns it.
-		// Sleeping before retrying avoids hammering the API on transient failures.
-		// AllowedUpdates restricts delivery to inline queries only, so Update
-		// can safely access update.InlineQuery without a nil check.
-		log.Println(dsp.PollOptions(false, echotron.UpdateOptions{
-			AllowedUpdates: []echotron.UpdateType{echotron.InlineQueryUpdate},
-			Timeout:        120,
-		}))
-		time.Sleep(5 * time.Second)
-	}
+	// PollOptions retries transient failures on its own with an exponential
+	// backoff and only returns on fatal errors, such as an invalid token.
+	// AllowedUpdates restricts delivery to inline queries only, so Update
+	// can safely access update.InlineQuery without a nil check.
+	log.Fatalln(dsp.PollOptions(false, echotron.UpdateOptions{
+		AllowedUpdates: []echotron.UpdateType{echotron.InlineQueryUpdate},
+		Timeout:        120,
+	}))
 }
@@ -7,7 +7,6 @@ package main
 import (
 	"log"
 	"os"
-	"time"
 
 	"github.com/NicoNex/echotron/v3"
 )
@@ -57,10 +56,7 @@ func (b *bot) Update(update *echotron.Update) {
 
 func main() {
 	dsp := echotron.NewDispatcher(token, newBot)
-	for {
-		// Poll blocks until a network error occurs, then returns it.
-		// Sleeping before retrying avoids hammering the API on transient failures.
-		log.Println(dsp.Poll())
-		time.Sleep(5 * time.Second)
-	}
+	// Poll retries transient failures on its own with an exponential backoff
+	// and only returns on fatal errors, such as an invalid token.
+	log.Fatalln(dsp.Poll())
 }
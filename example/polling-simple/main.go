@@ -19,7 +19,7 @@ func main() {
 	// It handles long-polling internally and reconnects on transient errors.
 	for u := range echotron.PollingUpdates(token) {
 		if u.Message != nil && u.Message.Text == "/start" {
-			api.SendMessage("Hello, world!", u.ChatID(), nil)
+			api.SendMessage("Hello, world!", u.Message.Chat.ID, nil)
 		}
 	}
 }
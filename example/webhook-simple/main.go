@@ -26,7 +26,7 @@ func main() {
 
 	for u := range updates {
 		if u.Message != nil && u.Message.Text == "/start" {
-			api.SendMessage("Hello, world!", u.ChatID(), nil)
+			api.SendMessage("Hello, world!", u.Message.Chat.ID, nil)
 		}
 	}
 }
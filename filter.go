@@ -0,0 +1,295 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// Filter reports whether an update matches some condition.
+// Filters can be combined with And, Or and Not, used as Middleware or to
+// route the updates with When.
+type Filter func(update *Update) bool
+
+// And returns a Filter matching the updates matched by all the filters.
+// The filters are evaluated in order and the evaluation stops at the first
+// one that doesn't match, so the expensive ones should come last.
+func And(filters ...Filter) Filter {
+	return func(update *Update) bool {
+		for _, f := range filters {
+			if !f(update) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or returns a Filter matching the updates matched by at least one of the
+// filters, which are evaluated in order until one matches.
+func Or(filters ...Filter) Filter {
+	return func(update *Update) bool {
+		for _, f := range filters {
+			if f(update) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a Filter matching the updates not matched by f.
+func Not(f Filter) Filter {
+	return func(update *Update) bool {
+		return !f(update)
+	}
+}
+
+// Middleware returns a Middleware that discards the updates not matched by f.
+func (f Filter) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if f(update) {
+				next(ctx, update)
+			}
+		}
+	}
+}
+
+// When returns a Middleware that passes the updates matched by f to h and all
+// the other updates to the next Handler.
+func When(f Filter, h Handler) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if f(update) {
+				h(ctx, update)
+				return
+			}
+			next(ctx, update)
+		}
+	}
+}
+
+// message returns the message, channel post or business message contained in
+// the update, be it new or edited, or nil if there's none.
+func (u Update) message() *Message {
+	switch {
+	case u.Message != nil:
+		return u.Message
+	case u.EditedMessage != nil:
+		return u.EditedMessage
+	case u.ChannelPost != nil:
+		return u.ChannelPost
+	case u.EditedChannelPost != nil:
+		return u.EditedChannelPost
+	case u.BusinessMessage != nil:
+		return u.BusinessMessage
+	case u.EditedBusinessMessage != nil:
+		return u.EditedBusinessMessage
+	default:
+		return nil
+	}
+}
+
+// messageFilter returns a Filter matching the updates containing a message
+// for which fn returns true.
+func messageFilter(fn func(m *Message) bool) Filter {
+	return func(update *Update) bool {
+		m := update.message()
+		return m != nil && fn(m)
+	}
+}
+
+// chat returns the chat of the message contained in the update, including
+// the one of the callback queries, or nil if there's none.
+func (u Update) chat() *Chat {
+	if m := u.message(); m != nil {
+		return &m.Chat
+	}
+	if u.CallbackQuery != nil && u.CallbackQuery.Message != nil {
+		return &u.CallbackQuery.Message.Chat
+	}
+	return nil
+}
+
+// OfType returns a Filter matching the updates of the given types.
+func OfType(types ...UpdateType) Filter {
+	return func(update *Update) bool {
+		t := update.Type()
+		for _, typ := range types {
+			if t == typ {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasText returns a Filter matching the messages with text.
+func HasText() Filter {
+	return messageFilter(func(m *Message) bool {
+		return m.Text != ""
+	})
+}
+
+// HasPhoto returns a Filter matching the messages with a photo.
+func HasPhoto() Filter {
+	return messageFilter(func(m *Message) bool {
+		return len(m.Photo) > 0
+	})
+}
+
+// HasDocument returns a Filter matching the messages with a document.
+func HasDocument() Filter {
+	return messageFilter(func(m *Message) bool {
+		return m.Document != nil
+	})
+}
+
+// ChatType returns a Filter matching the messages and the callback queries
+// coming from a chat of one of the given types, which are "private", "group",
+// "supergroup" and "channel".
+func ChatType(types ...string) Filter {
+	return func(update *Update) bool {
+		chat := update.chat()
+		if chat == nil {
+			return false
+		}
+
+		for _, t := range types {
+			if chat.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// InPrivate returns a Filter matching the updates coming from private chats.
+func InPrivate() Filter {
+	return ChatType("private")
+}
+
+// InGroup returns a Filter matching the updates coming from groups and
+// supergroups.
+func InGroup() Filter {
+	return ChatType("group", "supergroup")
+}
+
+// InChannel returns a Filter matching the updates coming from channels.
+func InChannel() Filter {
+	return ChatType("channel")
+}
+
+// FromAdmin returns a Filter matching the messages and the callback queries
+// sent by an administrator of their chat, including the anonymous ones.
+// Since it calls GetChatMember with api for each update, it should come last
+// in And.
+func FromAdmin(api API) Filter {
+	return func(update *Update) bool {
+		if m := update.message(); m != nil && m.SenderChat != nil && m.SenderChat.ID == m.Chat.ID {
+			return true
+		}
+
+		chat, user := update.chat(), update.Sender()
+		if chat == nil || user == nil {
+			return false
+		}
+
+		res, err := api.GetChatMember(chat.ID, user.ID)
+		if err != nil || res.Result == nil {
+			return false
+		}
+		return res.Result.Status == "creator" || res.Result.Status == "administrator"
+	}
+}
+
+// TextMatches returns a Filter matching the messages whose text or caption
+// matches the regular expression pattern, and panics if it doesn't compile.
+func TextMatches(pattern string) Filter {
+	re := regexp.MustCompile(pattern)
+	return messageFilter(func(m *Message) bool {
+		if m.Text != "" {
+			return re.MatchString(m.Text)
+		}
+		return m.Caption != "" && re.MatchString(m.Caption)
+	})
+}
+
+// IsCommand returns a Filter matching the messages containing one of the
+// given commands, without the leading slash, or any command if none is given.
+func IsCommand(names ...string) Filter {
+	return messageFilter(func(m *Message) bool {
+		cmd, ok := ParseCommand(m)
+		if !ok {
+			return false
+		}
+		if len(names) == 0 {
+			return true
+		}
+
+		for _, n := range names {
+			if strings.EqualFold(strings.TrimPrefix(n, "/"), cmd.Name) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// IsReply returns a Filter matching the messages replying to another message.
+func IsReply() Filter {
+	return messageFilter(func(m *Message) bool {
+		return m.ReplyToMessage != nil
+	})
+}
+
+// IsForwarded returns a Filter matching the forwarded messages.
+func IsForwarded() Filter {
+	return messageFilter(func(m *Message) bool {
+		return m.ForwardOrigin != nil
+	})
+}
+
+// InTopic returns a Filter matching the messages sent in the forum topic
+// with the given thread ID.
+func InTopic(threadID int) Filter {
+	return messageFilter(func(m *Message) bool {
+		return m.IsTopicMessage && m.ThreadID == threadID
+	})
+}
+
+// HasEntity returns a Filter matching the messages whose text or caption
+// contains an entity of one of the given types.
+func HasEntity(types ...MessageEntityType) Filter {
+	return messageFilter(func(m *Message) bool {
+		for _, entities := range [][]*MessageEntity{m.Entities, m.CaptionEntities} {
+			for _, e := range entities {
+				for _, t := range types {
+					if e.Type == t {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,103 @@
+package echotron
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	api := fakeAPI(t, func(method string, r *http.Request) string {
+		if method != "getChatMember" {
+			t.Errorf("unexpected method %s", method)
+		}
+		if r.FormValue("user_id") == "1" {
+			return `{"ok":true,"result":{"status":"administrator","user":{"id":1}}}`
+		}
+		return `{"ok":true,"result":{"status":"member","user":{"id":2}}}`
+	})
+
+	text := &Update{Message: &Message{
+		Text:           "/ban@examplebot spam",
+		Chat:           Chat{ID: -100, Type: "supergroup"},
+		From:           &User{ID: 1},
+		Entities:       []*MessageEntity{{Type: BotCommandEntity, Length: 15}},
+		ReplyToMessage: &Message{},
+		IsTopicMessage: true,
+		ThreadID:       7,
+	}}
+	photo := &Update{ChannelPost: &Message{
+		Photo:           []*PhotoSize{{}},
+		Caption:         "see https://example.com",
+		CaptionEntities: []*MessageEntity{{Type: UrlEntity}},
+		Chat:            Chat{ID: -200, Type: "channel"},
+		SenderChat:      &Chat{ID: -200},
+		ForwardOrigin:   &MessageOrigin{},
+	}}
+	private := &Update{EditedMessage: &Message{
+		Text:     "hello",
+		Document: &Document{},
+		Chat:     Chat{ID: 2, Type: "private"},
+		From:     &User{ID: 2},
+	}}
+	query := &Update{CallbackQuery: &CallbackQuery{Data: "x"}}
+
+	cases := []struct {
+		name    string
+		filter  Filter
+		matches []*Update
+	}{
+		{"HasText", HasText(), []*Update{text, private}},
+		{"HasPhoto", HasPhoto(), []*Update{photo}},
+		{"HasDocument", HasDocument(), []*Update{private}},
+		{"InPrivate", InPrivate(), []*Update{private}},
+		{"InGroup", InGroup(), []*Update{text}},
+		{"InChannel", InChannel(), []*Update{photo}},
+		{"FromAdmin", FromAdmin(api), []*Update{text, photo}},
+		{"TextMatches", TextMatches(`^hel+o$|example\.com`), []*Update{photo, private}},
+		{"IsCommand", IsCommand("/BAN"), []*Update{text}},
+		{"IsCommand any", IsCommand(), []*Update{text}},
+		{"IsReply", IsReply(), []*Update{text}},
+		{"IsForwarded", IsForwarded(), []*Update{photo}},
+		{"InTopic", InTopic(7), []*Update{text}},
+		{"HasEntity", HasEntity(UrlEntity, MentionEntity), []*Update{photo}},
+		{"OfType", OfType(CallbackQueryUpdate, EditedMessageUpdate), []*Update{private, query}},
+		{"And", And(HasText(), Not(InPrivate())), []*Update{text}},
+		{"Or", Or(HasPhoto(), HasDocument()), []*Update{photo, private}},
+		{"Not", Not(HasText()), []*Update{photo, query}},
+	}
+
+	for _, c := range cases {
+		for _, u := range []*Update{text, photo, private, query} {
+			expected := false
+			for _, m := range c.matches {
+				expected = expected || m == u
+			}
+			if got := c.filter(u); got != expected {
+				t.Errorf("%s(%s): expected %t, got %t", c.name, u.Type(), expected, got)
+			}
+		}
+	}
+}
+
+func TestFilterMiddleware(t *testing.T) {
+	var handled, passed int
+
+	d := NewDispatcher("token", nil)
+	d.Use(
+		When(IsCommand("start"), func(context.Context, *Update) { handled++ }),
+		Not(InChannel()).Middleware(),
+	)
+	h := d.chain(func(context.Context, *Update) { passed++ })
+
+	h(context.Background(), &Update{Message: &Message{
+		Text:     "/start",
+		Entities: []*MessageEntity{{Type: BotCommandEntity, Length: 6}},
+	}})
+	h(context.Background(), &Update{Message: &Message{Text: "hi"}})
+	h(context.Background(), &Update{ChannelPost: &Message{Chat: Chat{Type: "channel"}}})
+
+	if handled != 1 || passed != 1 {
+		t.Fatalf("expected 1 handled and 1 passed, got %d and %d", handled, passed)
+	}
+}
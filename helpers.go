@@ -35,7 +35,11 @@ type content struct {
 
 func check(r APIResponse) error {
 	if b := r.Base(); !b.Ok {
-		return &APIError{code: b.ErrorCode, desc: b.Description}
+		err := &APIError{code: b.ErrorCode, desc: b.Description}
+		if b.Parameters != nil {
+			err.retryAfter = b.Parameters.RetryAfter
+		}
+		return err
 	}
 	return nil
 }
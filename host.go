@@ -0,0 +1,205 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Host serves the webhooks of many bots from a single HTTP(S) server, routing
+// the requests to the Dispatcher of each bot by path.
+// Every Dispatcher keeps its own sessions, and since the rate limiters are
+// per token, the bots don't slow each other down.
+type Host struct {
+	baseURL string
+	bots    map[string]*Dispatcher
+	pending map[string]string
+	srv     *http.Server
+	mu      sync.RWMutex
+}
+
+// NewHost returns a new Host whose server is reachable by Telegram at baseURL,
+// eg: 'https://example.com:8443'.
+func NewHost(baseURL string) *Host {
+	return &Host{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		bots:    make(map[string]*Dispatcher),
+		pending: make(map[string]string),
+	}
+}
+
+// AddBot registers d under path and sets its webhook to the base URL of the
+// Host followed by path.
+// If opts doesn't specify a secret token, a random one is generated, so that
+// a bot can't receive the updates meant for another one.
+// Bots can be added while the Host is serving.
+func (h *Host) AddBot(path string, d *Dispatcher, dropPendingUpdates bool, opts *WebhookOptions) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("echotron: invalid path %q, it must start with /", path)
+	}
+
+	whURL, err := url.JoinPath(h.baseURL, path)
+	if err != nil {
+		return err
+	}
+
+	var whOpts WebhookOptions
+	if opts = d.webhookOptions(opts); opts != nil {
+		whOpts = *opts
+	}
+	if whOpts.SecretToken == "" {
+		if whOpts.SecretToken, err = newSecretToken(); err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	if _, ok := h.bots[path]; ok {
+		h.mu.Unlock()
+		return fmt.Errorf("echotron: path %s already in use", path)
+	}
+	// The bot is registered first so that it doesn't miss the first updates,
+	// but until SetWebhook succeeds its requests are checked against the new
+	// secret token kept by the Host, so that a failure doesn't lock out a
+	// Dispatcher that is already serving.
+	h.bots[path] = d
+	h.pending[path] = whOpts.SecretToken
+	h.mu.Unlock()
+
+	_, err = d.api.SetWebhook(whURL, dropPendingUpdates, &whOpts)
+	if err == nil {
+		d.SetSecretToken(whOpts.SecretToken)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// The bot may have been removed meanwhile.
+	if h.bots[path] == d {
+		delete(h.pending, path)
+		if err != nil {
+			delete(h.bots, path)
+		}
+	}
+	return err
+}
+
+// RemoveBot deletes the webhook of the bot registered under path, stops routing
+// its requests and shuts its Dispatcher down.
+func (h *Host) RemoveBot(path string, dropPendingUpdates bool) error {
+	h.mu.Lock()
+	d, ok := h.bots[path]
+	delete(h.bots, path)
+	delete(h.pending, path)
+	h.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("echotron: no bot registered under path %s", path)
+	}
+
+	defer d.Shutdown()
+	_, err := d.api.DeleteWebhook(dropPendingUpdates)
+	return err
+}
+
+// Bot returns the Dispatcher registered under path, if any.
+func (h *Host) Bot(path string) (*Dispatcher, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	d, ok := h.bots[path]
+	return d, ok
+}
+
+// ServeHTTP passes the request to the Dispatcher registered under its path, or
+// answers with 404 if there's none.
+// While the webhook of a bot is being set, its requests must carry the new
+// secret token.
+func (h *Host) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	d, ok := h.bots[r.URL.Path]
+	token, pending := h.pending[r.URL.Path]
+	h.mu.RUnlock()
+
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case pending:
+		d.handleWebhook(w, r, token)
+	default:
+		d.HandleWebhook(w, r)
+	}
+}
+
+// ListenAndServe serves the webhooks over HTTP on addr, for when the Host is
+// behind a reverse proxy terminating TLS.
+func (h *Host) ListenAndServe(addr string) error {
+	return h.server(addr).ListenAndServe()
+}
+
+// ListenAndServeTLS serves the webhooks over HTTPS on addr, with the
+// certificate and the key read from certFile and keyFile.
+func (h *Host) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	return h.server(addr).ListenAndServeTLS(certFile, keyFile)
+}
+
+// Shutdown gracefully stops the server and then shuts down the Dispatchers of
+// all the bots, without deleting their webhooks.
+func (h *Host) Shutdown(ctx context.Context) error {
+	var err error
+
+	h.mu.RLock()
+	srv := h.srv
+	h.mu.RUnlock()
+
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, d := range h.bots {
+		d.Shutdown()
+	}
+	return err
+}
+
+// server returns the http.Server of the Host, listening on addr.
+func (h *Host) server(addr string) *http.Server {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.srv = &http.Server{Addr: addr, Handler: h}
+	return h.srv
+}
+
+// newSecretToken returns a random secret token for a webhook.
+func newSecretToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
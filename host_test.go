@@ -0,0 +1,170 @@
+package echotron
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		webhooks = make(map[string]string)
+		deleted  bool
+		received = make(chan string, 2)
+	)
+
+	newBot := func(name string) *Dispatcher {
+		d := NewDispatcher(name, func(_ int64) Bot {
+			return botFunc(func(_ *Update) { received <- name })
+		})
+		d.api = fakeAPI(t, func(method string, r *http.Request) string {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch method {
+			case "setWebhook":
+				webhooks[r.FormValue("url")] = r.FormValue("secret_token")
+			case "deleteWebhook":
+				deleted = true
+			}
+			return `{"ok":true}`
+		})
+		return d
+	}
+
+	h := NewHost("https://example.com:8443/")
+	if err := h.AddBot("/a", newBot("a"), false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddBot("/b", newBot("b"), false, &WebhookOptions{SecretToken: "secret-b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddBot("/a", newBot("c"), false, nil); err == nil {
+		t.Fatal("expected an error for a duplicate path")
+	}
+	if err := h.AddBot("c", newBot("c"), false, nil); err == nil {
+		t.Fatal("expected an error for an invalid path")
+	}
+
+	secretA := webhooks["https://example.com:8443/a"]
+	if secretA == "" || webhooks["https://example.com:8443/b"] != "secret-b" {
+		t.Fatalf("unexpected webhooks %v", webhooks)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(path, secret string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(`{"update_id":1,"message":{"chat":{"id":1}}}`))
+		req.Header.Set(secretTokenHeader, secret)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := post("/a", secretA); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if name := <-received; name != "a" {
+		t.Fatalf("update delivered to %s", name)
+	}
+	if code := post("/b", secretA); code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 with the secret of another bot, got %d", code)
+	}
+
+	if err := h.RemoveBot("/a", false); err != nil {
+		t.Fatal(err)
+	}
+	if code := post("/a", secretA); code != http.StatusNotFound || !deleted {
+		t.Fatalf("expected status 404 and webhook deleted, got %d", code)
+	}
+	if err := h.RemoveBot("/a", false); err == nil {
+		t.Fatal("expected an error removing a bot twice")
+	}
+}
+
+func TestHostAddBotKeepsSecret(t *testing.T) {
+	newBot := func(ok bool) *Dispatcher {
+		d := NewDispatcher("token", nil)
+		d.SetSecretToken("old")
+		d.api = fakeAPI(t, func(_ string, _ *http.Request) string {
+			if ok {
+				return `{"ok":true}`
+			}
+			return `{"ok":false,"error_code":400,"description":"Bad Request: bad webhook"}`
+		})
+		return d
+	}
+
+	h := NewHost("https://example.com")
+	if err := h.AddBot("/a", newBot(true), false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dup := newBot(true)
+	if err := h.AddBot("/a", dup, false, nil); err == nil {
+		t.Fatal("expected an error for a duplicate path")
+	}
+	failed := newBot(false)
+	if err := h.AddBot("/b", failed, false, nil); err == nil {
+		t.Fatal("expected an error from SetWebhook")
+	}
+
+	if dup.secret() != "old" || failed.secret() != "old" {
+		t.Fatalf("expected the secret to be kept, got %q and %q", dup.secret(), failed.secret())
+	}
+	if _, ok := h.Bot("/b"); ok {
+		t.Fatal("unexpected bot registered under /b")
+	}
+}
+
+func TestHostPendingBot(t *testing.T) {
+	var (
+		h       = NewHost("https://example.com")
+		d       = NewDispatcher("token", func(_ int64) Bot { return botFunc(func(_ *Update) {}) })
+		secret  = make(chan string)
+		release = make(chan struct{})
+	)
+
+	d.api = fakeAPI(t, func(_ string, r *http.Request) string {
+		secret <- r.FormValue("secret_token")
+		<-release
+		return `{"ok":false,"error_code":400,"description":"Bad Request: bad webhook"}`
+	})
+
+	errc := make(chan error)
+	go func() { errc <- h.AddBot("/a", d, false, nil) }()
+	token := <-secret
+
+	post := func(secret string) int {
+		req := httptest.NewRequest(http.MethodPost, "/a", strings.NewReader(`{"update_id":1,"message":{"chat":{"id":1}}}`))
+		req.Header.Set(secretTokenHeader, secret)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without the pending secret, got %d", code)
+	}
+	if code := post(token); code != http.StatusOK {
+		t.Fatalf("expected status 200 with the pending secret, got %d", code)
+	}
+
+	close(release)
+	if err := <-errc; err == nil {
+		t.Fatal("expected an error from SetWebhook")
+	}
+	if d.secret() != "" {
+		t.Fatalf("expected the secret of the Dispatcher untouched, got %q", d.secret())
+	}
+	if code := post(token); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 after the failure, got %d", code)
+	}
+}
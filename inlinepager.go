@@ -0,0 +1,418 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxInlineResults is the maximum number of results Telegram accepts in a
+// single answer to an inline query.
+const MaxInlineResults = 50
+
+// inlineChosenTTL is how long the results sent by an InlinePager are kept to
+// be matched with the chosen inline results.
+const inlineChosenTTL = time.Hour
+
+// inlineChosenLimit is the maximum number of results an InlinePager keeps to
+// be matched with the chosen inline results, the oldest ones are dropped
+// first.
+const inlineChosenLimit = 10000
+
+// errInlineSearch is returned to the queries waiting for a search that panicked.
+var errInlineSearch = errors.New("echotron: inline search failed")
+
+// InlineSearchFunc returns the results for query starting from the one at
+// offset, at most limit.
+// The limit is one more than the page size, so that the InlinePager can tell
+// whether there's a next page without an extra call.
+type InlineSearchFunc func(ctx context.Context, query *InlineQuery, offset, limit int) ([]InlineQueryResult, error)
+
+// InlinePagerOptions contains the optional parameters used by NewInlinePager.
+type InlinePagerOptions struct {
+	// Button is the button shown above the results, if any.
+	Button *InlineQueryResultsButton
+	// PageSize is the number of results of each page, MaxInlineResults if 0
+	// or greater.
+	PageSize int
+	// CacheTime is how long the pages are cached, both by the pager and by
+	// Telegram, 0 disables the cache.
+	// Unlike with AnswerInlineQuery, 0 is sent to Telegram as well instead of
+	// leaving it to its default of 300 seconds.
+	CacheTime time.Duration
+	// Debounce is how long to wait for the user to stop typing before
+	// searching: a query followed by another one of the same user within
+	// Debounce is never answered.
+	// It only applies to the first page of the results.
+	Debounce time.Duration
+	// Personal tells that the results depend on the user who sent the query,
+	// so that they're cached for each user.
+	Personal bool
+}
+
+// InlinePager answers the inline queries with the results of an
+// InlineSearchFunc, taking care of the pagination, the caching and the
+// debouncing of the queries, and matches the chosen inline results with the
+// results they come from.
+type InlinePager struct {
+	api      API
+	search   InlineSearchFunc
+	opts     InlinePagerOptions
+	onChosen func(ctx context.Context, update *Update, result InlineQueryResult)
+	cache    map[inlinePageKey]inlinePage
+	calls    map[inlinePageKey]*inlineCall
+	latest   map[int64]uint64
+	chosen   map[inlineChosenKey]inlineChosen
+	swept    time.Time
+	mu       sync.Mutex
+}
+
+// inlinePageKey identifies a page of results, user is 0 unless the results
+// are personal.
+type inlinePageKey struct {
+	query  string
+	offset int
+	user   int64
+}
+
+// inlinePage is a page of results ready to be sent.
+type inlinePage struct {
+	expires time.Time
+	results []InlineQueryResult
+	next    string
+}
+
+// inlineCall is a search in progress, shared by the identical queries that
+// arrive meanwhile.
+type inlineCall struct {
+	done chan struct{}
+	page inlinePage
+	err  error
+}
+
+// inlineChosenKey identifies a result sent to a user in answer to a query,
+// since the result IDs are usually only unique within an answer.
+type inlineChosenKey struct {
+	query string
+	id    string
+	user  int64
+}
+
+// inlineChosen is a result sent in an answer.
+type inlineChosen struct {
+	expires time.Time
+	result  InlineQueryResult
+}
+
+// NewInlinePager returns a new InlinePager that answers the inline queries
+// with api using the results of search.
+func NewInlinePager(api API, search InlineSearchFunc, opts InlinePagerOptions) *InlinePager {
+	if opts.PageSize <= 0 || opts.PageSize > MaxInlineResults {
+		opts.PageSize = MaxInlineResults
+	}
+
+	return &InlinePager{
+		api:    api,
+		search: search,
+		opts:   opts,
+		cache:  make(map[inlinePageKey]inlinePage),
+		calls:  make(map[inlinePageKey]*inlineCall),
+		latest: make(map[int64]uint64),
+		chosen: make(map[inlineChosenKey]inlineChosen),
+	}
+}
+
+// OnChosen sets the function called with the chosen inline results, along
+// with the result they refer to, or nil if it's no longer known.
+// The results are only kept once OnChosen has been called, so it should be
+// called before the pager starts answering the queries.
+// Telegram only sends the chosen inline results to the bots that enabled
+// inline feedback with @BotFather.
+func (p *InlinePager) OnChosen(fn func(ctx context.Context, update *Update, result InlineQueryResult)) {
+	p.mu.Lock()
+	p.onChosen = fn
+	p.mu.Unlock()
+}
+
+// Answer answers query with the page of results requested by its offset.
+// With a Debounce, it waits before searching and returns nil without
+// answering if the user sends another query meanwhile.
+func (p *InlinePager) Answer(ctx context.Context, query *InlineQuery) error {
+	offset, err := strconv.Atoi(query.Offset)
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	var user int64
+	if query.From != nil {
+		user = query.From.ID
+	}
+
+	if offset == 0 && p.opts.Debounce > 0 {
+		if ok, err := p.debounce(ctx, user); !ok {
+			return err
+		}
+	}
+
+	key := inlinePageKey{query: query.Query, offset: offset}
+	if p.opts.Personal {
+		key.user = user
+	}
+
+	page, err := p.page(ctx, key, query)
+	if err != nil {
+		return err
+	}
+	p.remember(user, query.Query, page.results)
+
+	return p.answer(query.ID, page)
+}
+
+// answer sends page in answer to the inline query with the given ID.
+// It's like AnswerInlineQuery but it always sends the cache time, since the
+// zero values of InlineQueryOptions are left out of the request.
+func (p *InlinePager) answer(id string, page inlinePage) error {
+	var (
+		res  APIResponseBase
+		vals = make(url.Values)
+		opts = InlineQueryOptions{
+			NextOffset: page.next,
+			IsPersonal: p.opts.Personal,
+		}
+	)
+
+	if p.opts.Button != nil {
+		opts.Button = *p.opts.Button
+	}
+
+	jsn, _ := json.Marshal(page.results)
+	vals.Set("inline_query_id", id)
+	vals.Set("results", string(jsn))
+	vals.Set("cache_time", strconv.Itoa(int(p.opts.CacheTime/time.Second)))
+	return p.api.lclient.get(p.api.base, "answerInlineQuery", addValues(vals, &opts), &res)
+}
+
+// debounce waits for p.opts.Debounce and reports whether the user didn't send
+// other queries meanwhile.
+func (p *InlinePager) debounce(ctx context.Context, user int64) (bool, error) {
+	p.mu.Lock()
+	p.latest[user]++
+	gen := p.latest[user]
+	p.mu.Unlock()
+
+	t := time.NewTimer(p.opts.Debounce)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.latest[user] != gen {
+		return false, nil
+	}
+	delete(p.latest, user)
+	return true, nil
+}
+
+// page returns the page of key from the cache or from the search function,
+// sharing the search among the identical queries arrived at the same time.
+func (p *InlinePager) page(ctx context.Context, key inlinePageKey, query *InlineQuery) (inlinePage, error) {
+	p.mu.Lock()
+	if page, ok := p.cache[key]; ok && time.Now().Before(page.expires) {
+		p.mu.Unlock()
+		return page, nil
+	}
+	if c, ok := p.calls[key]; ok {
+		p.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.page, c.err
+		case <-ctx.Done():
+			return inlinePage{}, ctx.Err()
+		}
+	}
+	c := &inlineCall{done: make(chan struct{}), err: errInlineSearch}
+	p.calls[key] = c
+	p.mu.Unlock()
+
+	// The call is released even if the search panics, so that the identical
+	// queries waiting for it don't hang.
+	defer func() {
+		p.mu.Lock()
+		delete(p.calls, key)
+		if c.err == nil && p.opts.CacheTime > 0 {
+			now := time.Now()
+			c.page.expires = now.Add(p.opts.CacheTime)
+			p.cache[key] = c.page
+			p.sweep(now)
+		}
+		p.mu.Unlock()
+		close(c.done)
+	}()
+
+	results, err := p.search(ctx, query, key.offset, p.opts.PageSize+1)
+	if len(results) > p.opts.PageSize {
+		results = results[:p.opts.PageSize]
+		c.page.next = strconv.Itoa(key.offset + p.opts.PageSize)
+	}
+	c.page.results, c.err = results, err
+	return c.page, c.err
+}
+
+// remember keeps the results sent to user in answer to query to match them
+// with the chosen inline results, if there's a function to pass them to.
+func (p *InlinePager) remember(user int64, query string, results []InlineQueryResult) {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.onChosen == nil {
+		return
+	}
+	for _, r := range results {
+		if id := inlineResultID(r); id != "" {
+			key := inlineChosenKey{query: query, id: id, user: user}
+			p.chosen[key] = inlineChosen{expires: now.Add(inlineChosenTTL), result: r}
+		}
+	}
+	p.sweep(now)
+	if len(p.chosen) > inlineChosenLimit {
+		p.evict()
+	}
+}
+
+// evict drops the oldest results so that only three quarters of
+// inlineChosenLimit are left, making room for the next ones.
+// It must be called with p.mu held.
+func (p *InlinePager) evict() {
+	expires := make([]time.Time, 0, len(p.chosen))
+	for _, c := range p.chosen {
+		expires = append(expires, c.expires)
+	}
+	sort.Slice(expires, func(i, j int) bool {
+		return expires[i].Before(expires[j])
+	})
+
+	cutoff := expires[len(expires)-inlineChosenLimit*3/4]
+	for key, c := range p.chosen {
+		if c.expires.Before(cutoff) {
+			delete(p.chosen, key)
+		}
+	}
+}
+
+// sweep removes the expired pages and results, at most once per minute.
+// It must be called with p.mu held.
+func (p *InlinePager) sweep(now time.Time) {
+	if now.Sub(p.swept) < time.Minute {
+		return
+	}
+	p.swept = now
+
+	for k, page := range p.cache {
+		if now.After(page.expires) {
+			delete(p.cache, k)
+		}
+	}
+	for key, c := range p.chosen {
+		if now.After(c.expires) {
+			delete(p.chosen, key)
+		}
+	}
+}
+
+// inlineResultID returns the ID of the result, all the InlineQueryResult
+// types have one.
+func inlineResultID(r InlineQueryResult) string {
+	v := reflect.Indirect(reflect.ValueOf(r))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if f := v.FieldByName("ID"); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	return ""
+}
+
+// Route answers the inline query of update or passes its chosen inline result
+// to the function set with OnChosen, and reports whether it did.
+// The errors occurred while answering are logged with the standard logger.
+func (p *InlinePager) Route(ctx context.Context, update *Update) bool {
+	switch {
+	case update.InlineQuery != nil:
+		if err := p.Answer(ctx, update.InlineQuery); err != nil {
+			log.Println("echotron.InlinePager", "Answer", err)
+		}
+		return true
+
+	case update.ChosenInlineResult != nil:
+		chosen := update.ChosenInlineResult
+		key := inlineChosenKey{query: chosen.Query, id: chosen.ResultID}
+		if chosen.From != nil {
+			key.user = chosen.From.ID
+		}
+
+		p.mu.Lock()
+		fn, c := p.onChosen, p.chosen[key]
+		p.mu.Unlock()
+
+		if fn == nil {
+			return false
+		}
+		fn(ctx, update, c.result)
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Middleware returns a Middleware that routes the inline queries and the
+// chosen inline results with Route and passes all the other updates to the
+// next Handler.
+func (p *InlinePager) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if !p.Route(ctx, update) {
+				next(ctx, update)
+			}
+		}
+	}
+}
+
+// AllowedUpdates returns the update types handled by the pager, so that it
+// can be registered with Dispatcher.Subscribe.
+func (p *InlinePager) AllowedUpdates() []UpdateType {
+	return []UpdateType{InlineQueryUpdate, ChosenInlineResultUpdate}
+}
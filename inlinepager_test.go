@@ -0,0 +1,238 @@
+package echotron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type inlineAnswer struct {
+	id       string
+	next     string
+	personal string
+	cache    string
+	results  int
+}
+
+func inlineAPI(t *testing.T) (API, func() []inlineAnswer) {
+	var (
+		mu      sync.Mutex
+		answers []inlineAnswer
+	)
+
+	api := fakeAPI(t, func(method string, r *http.Request) string {
+		var results []map[string]any
+		if err := json.Unmarshal([]byte(r.FormValue("results")), &results); err != nil {
+			t.Errorf("invalid results: %v", err)
+		}
+
+		mu.Lock()
+		answers = append(answers, inlineAnswer{
+			id:       r.FormValue("inline_query_id"),
+			next:     r.FormValue("next_offset"),
+			personal: r.FormValue("is_personal"),
+			cache:    r.FormValue("cache_time"),
+			results:  len(results),
+		})
+		mu.Unlock()
+		return `{"ok":true,"result":true}`
+	})
+
+	return api, func() []inlineAnswer {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]inlineAnswer(nil), answers...)
+	}
+}
+
+func searchN(n int, calls *int32) InlineSearchFunc {
+	return func(_ context.Context, q *InlineQuery, offset, limit int) ([]InlineQueryResult, error) {
+		atomic.AddInt32(calls, 1)
+		var res []InlineQueryResult
+		for i := offset; i < n && i < offset+limit; i++ {
+			res = append(res, InlineQueryResultArticle{
+				Type:  InlineArticle,
+				ID:    q.Query + strconv.Itoa(i),
+				Title: strconv.Itoa(i),
+			})
+		}
+		return res, nil
+	}
+}
+
+func TestInlinePagerPages(t *testing.T) {
+	var calls int32
+	api, answers := inlineAPI(t)
+	p := NewInlinePager(api, searchN(120, &calls), InlinePagerOptions{CacheTime: time.Minute})
+
+	for i, offset := range []string{"", "50", "100", "", "garbage"} {
+		q := &InlineQuery{ID: strconv.Itoa(i), Query: "go", Offset: offset, From: &User{ID: 1}}
+		if err := p.Answer(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []inlineAnswer{
+		{id: "0", next: "50", cache: "60", results: 50},
+		{id: "1", next: "100", cache: "60", results: 50},
+		{id: "2", next: "", cache: "60", results: 20},
+		{id: "3", next: "50", cache: "60", results: 50},
+		{id: "4", next: "50", cache: "60", results: 50},
+	}
+	for i, a := range answers() {
+		a.personal = ""
+		if a != expected[i] {
+			t.Errorf("answer %d: expected %+v, got %+v", i, expected[i], a)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 searches with the cache, got %d", calls)
+	}
+}
+
+func TestInlinePagerPersonal(t *testing.T) {
+	var calls int32
+	api, answers := inlineAPI(t)
+	p := NewInlinePager(api, searchN(5, &calls), InlinePagerOptions{
+		PageSize:  2,
+		CacheTime: time.Minute,
+		Personal:  true,
+	})
+
+	for i, user := range []int64{1, 2, 1} {
+		q := &InlineQuery{ID: strconv.Itoa(i), Query: "go", From: &User{ID: user}}
+		if err := p.Answer(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, a := range answers() {
+		if a.personal != "true" || a.results != 2 || a.next != "2" {
+			t.Fatalf("unexpected answer %+v", a)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected a search for each user, got %d", calls)
+	}
+}
+
+func TestInlinePagerNoCache(t *testing.T) {
+	var calls int32
+	api, answers := inlineAPI(t)
+	p := NewInlinePager(api, searchN(5, &calls), InlinePagerOptions{})
+
+	for i := 0; i < 2; i++ {
+		if err := p.Answer(context.Background(), &InlineQuery{ID: strconv.Itoa(i), Query: "go"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, a := range answers() {
+		if a.cache != "0" {
+			t.Fatalf("expected cache_time 0 to be sent, got %q", a.cache)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected a search for each query without the cache, got %d", calls)
+	}
+}
+
+func TestInlinePagerDebounce(t *testing.T) {
+	var calls int32
+	api, answers := inlineAPI(t)
+	p := NewInlinePager(api, searchN(5, &calls), InlinePagerOptions{Debounce: 50 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i, text := range []string{"g", "go", "gol"} {
+		wg.Add(1)
+		go func(id, text string) {
+			defer wg.Done()
+			p.Answer(context.Background(), &InlineQuery{ID: id, Query: text, From: &User{ID: 1}})
+		}(fmt.Sprint(i), text)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if a := answers(); len(a) != 1 || a[0].id != "2" || calls != 1 {
+		t.Fatalf("expected only the last query to be answered, got %+v", a)
+	}
+}
+
+func TestInlinePagerChosen(t *testing.T) {
+	var calls int32
+	api, _ := inlineAPI(t)
+	p := NewInlinePager(api, searchN(5, &calls), InlinePagerOptions{})
+
+	chosen := make(chan InlineQueryResult, 2)
+	p.OnChosen(func(_ context.Context, _ *Update, r InlineQueryResult) {
+		chosen <- r
+	})
+
+	h := p.Middleware()(func(context.Context, *Update) {
+		t.Error("unexpected update passed on")
+	})
+	h(context.Background(), &Update{InlineQuery: &InlineQuery{ID: "1", Query: "go", From: &User{ID: 1}}})
+	h(context.Background(), &Update{ChosenInlineResult: &ChosenInlineResult{ResultID: "go3", Query: "go", From: &User{ID: 1}}})
+	h(context.Background(), &Update{ChosenInlineResult: &ChosenInlineResult{ResultID: "unknown"}})
+
+	if r, ok := (<-chosen).(InlineQueryResultArticle); !ok || r.Title != "3" {
+		t.Fatalf("expected result go3, got %+v", r)
+	}
+	if r := <-chosen; r != nil {
+		t.Fatalf("expected nil for an unknown result, got %+v", r)
+	}
+}
+
+func TestInlinePagerChosenUsers(t *testing.T) {
+	api, _ := inlineAPI(t)
+	p := NewInlinePager(api, func(_ context.Context, q *InlineQuery, offset, limit int) ([]InlineQueryResult, error) {
+		// The IDs are only unique within an answer.
+		return []InlineQueryResult{InlineQueryResultArticle{Type: InlineArticle, ID: "0", Title: q.Query}}, nil
+	}, InlinePagerOptions{Personal: true})
+
+	var got string
+	p.OnChosen(func(_ context.Context, _ *Update, r InlineQueryResult) {
+		got = r.(InlineQueryResultArticle).Title
+	})
+
+	ctx := context.Background()
+	p.Answer(ctx, &InlineQuery{ID: "1", Query: "alice-secret", From: &User{ID: 1}})
+	p.Answer(ctx, &InlineQuery{ID: "2", Query: "bob", From: &User{ID: 2}})
+
+	p.Route(ctx, &Update{ChosenInlineResult: &ChosenInlineResult{ResultID: "0", Query: "alice-secret", From: &User{ID: 1}}})
+	if got != "alice-secret" {
+		t.Fatalf("expected the result of user 1, got %q", got)
+	}
+	p.Route(ctx, &Update{ChosenInlineResult: &ChosenInlineResult{ResultID: "0", Query: "bob", From: &User{ID: 2}}})
+	if got != "bob" {
+		t.Fatalf("expected the result of user 2, got %q", got)
+	}
+}
+
+func TestInlinePagerChosenLimit(t *testing.T) {
+	api, _ := inlineAPI(t)
+	p := NewInlinePager(api, nil, InlinePagerOptions{})
+
+	results := []InlineQueryResult{InlineQueryResultArticle{Type: InlineArticle, ID: "0"}}
+	p.remember(1, "go", results)
+	if n := len(p.chosen); n != 0 {
+		t.Fatalf("expected no results kept without OnChosen, got %d", n)
+	}
+
+	p.OnChosen(func(context.Context, *Update, InlineQueryResult) {})
+	for i := 0; i < 2*inlineChosenLimit; i++ {
+		p.remember(1, strconv.Itoa(i), results)
+	}
+	if n := len(p.chosen); n > inlineChosenLimit {
+		t.Fatalf("expected at most %d results kept, got %d", inlineChosenLimit, n)
+	}
+	if _, ok := p.chosen[inlineChosenKey{query: strconv.Itoa(2*inlineChosenLimit - 1), id: "0", user: 1}]; !ok {
+		t.Fatal("expected the most recent result to be kept")
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// UpdateJournal is a durable queue in which the Dispatcher writes the updates
+// received via webhook before acknowledging them to Telegram, and from which it
+// removes them once they've been processed.
+// The updates still pending when the process stops are replayed on the next
+// start, so that every update is processed at least once.
+type UpdateJournal interface {
+	// Append durably stores update as pending.
+	Append(update *Update) error
+	// Ack marks the update with the given ID as processed.
+	// IDs of updates that aren't pending must be ignored.
+	Ack(updateID int) error
+	// Pending returns the updates appended and not yet acknowledged, ordered
+	// by ID.
+	Pending() ([]*Update, error)
+}
+
+// journalCompactAfter is the number of acknowledged entries after which
+// FileJournal rewrites its file with the pending updates only.
+const journalCompactAfter = 1024
+
+// journalEntry is a line of the file of a FileJournal: either an appended
+// update or the acknowledgement of one.
+type journalEntry struct {
+	Update *Update `json:"update,omitempty"`
+	Ack    int     `json:"ack,omitempty"`
+}
+
+// FileJournal is an UpdateJournal backed by an append-only file in which each
+// line records either an update or the acknowledgement of one.
+// The file is synced on each Append and periodically rewritten with only the
+// pending updates, to keep its size proportional to the backlog.
+type FileJournal struct {
+	path    string
+	file    *os.File
+	pending map[int]*Update
+	acked   int
+	mu      sync.Mutex
+}
+
+// NewFileJournal opens the journal stored in the file at path, creating it if
+// it doesn't exist.
+// A truncated last line, left by a crash in the middle of a write, is discarded.
+func NewFileJournal(path string) (*FileJournal, error) {
+	j := &FileJournal{
+		path:    path,
+		pending: make(map[int]*Update),
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Append writes update to the file and syncs it to disk.
+func (j *FileJournal) Append(update *Update) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(journalEntry{Update: update}); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.pending[update.ID] = update
+	return nil
+}
+
+// Ack records that the update with the given ID has been processed.
+func (j *FileJournal) Ack(updateID int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.pending[updateID]; !ok {
+		return nil
+	}
+
+	if err := j.write(journalEntry{Ack: updateID}); err != nil {
+		return err
+	}
+	delete(j.pending, updateID)
+
+	if j.acked++; j.acked >= journalCompactAfter {
+		return j.compact()
+	}
+	return nil
+}
+
+// Pending returns the updates not yet acknowledged, ordered by ID.
+func (j *FileJournal) Pending() ([]*Update, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ret := make([]*Update, 0, len(j.pending))
+	for _, u := range j.pending {
+		ret = append(ret, u)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].ID < ret[b].ID
+	})
+	return ret, nil
+}
+
+// Close closes the file of the journal.
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// load reads the pending updates from the file.
+func (j *FileJournal) load() error {
+	f, err := os.Open(j.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 2*maxUpdateSize)
+	for scanner.Scan() {
+		var e journalEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Only the last line can be incomplete.
+			if scanner.Scan() {
+				return err
+			}
+			break
+		}
+
+		if e.Update != nil {
+			j.pending[e.Update.ID] = e.Update
+		} else {
+			delete(j.pending, e.Ack)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact atomically replaces the file with one holding only the pending
+// updates, and reopens it for appending.
+func (j *FileJournal) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, u := range j.pending {
+		if err := enc.Encode(journalEntry{Update: u}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	j.acked = 0
+	return err
+}
+
+// write appends e to the file as a JSON line.
+func (j *FileJournal) write(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(b, '\n'))
+	return err
+}
+
+// SetJournal makes the Dispatcher write each update received via webhook to j
+// before acknowledging it to Telegram, and acknowledge it in j once its Bot has
+// processed it.
+// The updates left pending in j by a previous run are delivered right away,
+// so SetJournal must be called after the Dispatcher has been configured and
+// before it starts receiving updates.
+// Updates answered through SetWebhookReply aren't written to j, since Telegram
+// delivers them again if the process dies before replying.
+func (d *Dispatcher) SetJournal(j UpdateJournal) error {
+	pending, err := j.Pending()
+	if err != nil {
+		return err
+	}
+
+	d.journal = j
+	for _, u := range pending {
+		d.recent.seen(u.ID)
+		d.push(context.Background(), u, false)
+	}
+	return nil
+}
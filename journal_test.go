@@ -0,0 +1,170 @@
+package echotron
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pendingIDs(t *testing.T, j UpdateJournal) (ids []int) {
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range pending {
+		ids = append(ids, u.ID)
+	}
+	return
+}
+
+func TestFileJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := NewFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{3, 1, 2} {
+		if err := j.Append(&Update{ID: id, Message: &Message{Text: "hi"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Ack(42); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// Simulate a crash in the middle of a write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"update":{"update_id":4,"mess`)
+	f.Close()
+
+	j, err = NewFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if ids := pendingIDs(t, j); len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Fatalf("expected pending updates [2 3], got %v", ids)
+	}
+
+	pending, _ := j.Pending()
+	if pending[0].Message == nil || pending[0].Message.Text != "hi" {
+		t.Fatalf("unexpected update %+v", pending[0])
+	}
+}
+
+func TestFileJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := NewFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	for i := 1; i <= journalCompactAfter; i++ {
+		j.Append(&Update{ID: i})
+		j.Ack(i)
+	}
+	j.Append(&Update{ID: journalCompactAfter + 1})
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 1 {
+		t.Fatalf("expected 1 line after compaction, got %d", n)
+	}
+}
+
+func TestDispatcherJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	processed := make(chan int, 2)
+
+	j, err := NewFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	j.Append(&Update{ID: 1, Message: &Message{Chat: Chat{ID: 1}}})
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) { processed <- u.ID })
+	})
+	if err := d.SetJournal(j); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"update_id":2,"message":{"chat":{"id":1}}}`
+	rec := httptest.NewRecorder()
+	d.HandleWebhook(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	got := map[int]bool{<-processed: true, <-processed: true}
+	if !got[1] || !got[2] {
+		t.Fatalf("expected updates 1 and 2, got %v", got)
+	}
+
+	// The acknowledgement happens right after Update returns.
+	for i := 0; i < 100 && len(pendingIDs(t, j)) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if ids := pendingIDs(t, j); len(ids) != 0 {
+		t.Fatalf("expected no pending updates, got %v", ids)
+	}
+}
+
+func TestJournalAfterShutdown(t *testing.T) {
+	var (
+		journal = &ackJournal{}
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) {
+			if u.ID == 1 {
+				close(started)
+				<-release
+			}
+		})
+	})
+	d.SetConcurrency(1)
+	d.SetQueue(1, OverflowBlock)
+	if err := d.SetJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+
+	for id := 1; id <= 2; id++ {
+		d.push(context.Background(), &Update{ID: id, Message: &Message{Chat: Chat{ID: int64(id)}}}, false)
+	}
+	<-started
+	d.Shutdown()
+	close(release)
+
+	waitFor(t, func() bool {
+		s := d.Stats()
+		return s.Queued == 0 && s.Active == 0
+	})
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if len(journal.acked) != 1 || journal.acked[0] != 1 {
+		t.Fatalf("expected only update 1 to be acknowledged, got %v", journal.acked)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+)
+
+// Handler processes an update received by the Dispatcher.
+// The context carries the values attached by the middlewares.
+type Handler func(ctx context.Context, update *Update)
+
+// Middleware wraps a Handler to run some logic before or after it.
+// A Middleware can short-circuit the chain by not calling next, rewrite the
+// update by passing a different one to next, and attach values to the context
+// with context.WithValue.
+type Middleware func(next Handler) Handler
+
+// ContextBot is an optional interface for Bot.
+// If a Bot implements it, the Dispatcher calls UpdateContext instead of Update,
+// passing the context with the values attached by the middlewares.
+type ContextBot interface {
+	UpdateContext(ctx context.Context, update *Update)
+}
+
+// Use appends mw to the middlewares run on each update, in the given order,
+// before the session of the update is looked up or created.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) Use(mw ...Middleware) {
+	d.middlewares = append(d.middlewares, mw...)
+}
+
+// chain returns the Handler that passes the update through the middlewares
+// and then to last.
+func (d *Dispatcher) chain(last Handler) Handler {
+	h := last
+	for i := len(d.middlewares) - 1; i >= 0; i-- {
+		h = d.middlewares[i](h)
+	}
+	return h
+}
+
+// handle passes update through the middlewares and then to last, reporting
+// the panics to the error handler.
+func (d *Dispatcher) handle(ctx context.Context, update *Update, last Handler) {
+	h := d.chain(last)
+	d.safely(update, func() error {
+		h(ctx, update)
+		return nil
+	})
+}
+
+// deliver is the last Handler of the chain, which delivers the update to the
+// Bot of its session.
+func (d *Dispatcher) deliver(ctx context.Context, update *Update) {
+	if d.hold(ctx, update) {
+		return
+	}
+
+	err := d.process(update, func(bot Bot) error {
+		return callBot(ctx, bot, update)
+	})
+	// The updates discarded because of Shutdown stay pending, so that they're
+	// processed again after a restart.
+	if errors.Is(err, errDispatcherClosed) && postpone(ctx) {
+		return
+	}
+	if err != nil {
+		d.handleError(err)
+	}
+}
+
+// process looks up the Bot the update must be delivered to, passes it to call
+// and then saves the state of its session, if any.
+// The errors, as well as the panics raised by call, are returned as
+// *UpdateError.
+func (d *Dispatcher) process(update *Update, call func(Bot) error) error {
+	chatID, _ := update.ChatID()
+
+	bot, err := d.route(update)
+	if err != nil {
+		return &UpdateError{Err: err, Update: update, ChatID: chatID}
+	}
+	if bot == nil {
+		return nil
+	}
+
+	if err := protect(chatID, update, func() error { return call(bot) }); err != nil {
+		return err
+	}
+
+	if key, ok := d.sessionKey(update); ok {
+		if err := d.save(key, bot); err != nil {
+			return &UpdateError{Err: err, Update: update, ChatID: chatID}
+		}
+	}
+	return nil
+}
+
+// IgnoreBots returns a Middleware that discards the updates sent by other bots.
+func IgnoreBots() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if u := update.Sender(); u == nil || !u.IsBot {
+				next(ctx, update)
+			}
+		}
+	}
+}
+
+// AllowChats returns a Middleware that discards the updates not coming from
+// one of the given chats.
+func AllowChats(chatIDs ...int64) Middleware {
+	allowed := make(map[int64]bool, len(chatIDs))
+	for _, id := range chatIDs {
+		allowed[id] = true
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if id, ok := update.ChatID(); ok && allowed[id] {
+				next(ctx, update)
+			}
+		}
+	}
+}
+
+// DropEdited returns a Middleware that discards the edits of messages and
+// channel posts.
+func DropEdited() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, update *Update) {
+			if update.EditedMessage == nil &&
+				update.EditedChannelPost == nil &&
+				update.EditedBusinessMessage == nil {
+				next(ctx, update)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package echotron
+
+import (
+	"context"
+	"testing"
+)
+
+type ctxKey struct{}
+
+type contextBot struct {
+	values chan any
+}
+
+func (c contextBot) Update(_ *Update) {}
+
+func (c contextBot) UpdateContext(ctx context.Context, _ *Update) {
+	c.values <- ctx.Value(ctxKey{})
+}
+
+func TestMiddleware(t *testing.T) {
+	var (
+		created []int64
+		values  = make(chan any, 10)
+	)
+
+	d := NewDispatcher("token", func(chatID int64) Bot {
+		created = append(created, chatID)
+		return contextBot{values}
+	})
+	d.Use(
+		IgnoreBots(),
+		AllowChats(1, 2),
+		DropEdited(),
+		func(next Handler) Handler {
+			return func(ctx context.Context, u *Update) {
+				// Rewrite the update and attach a value to the context.
+				if u.Message.Chat.ID == 2 {
+					u = &Update{ID: u.ID, Message: &Message{Chat: Chat{ID: 1}}}
+				}
+				next(context.WithValue(ctx, ctxKey{}, u.ID), u)
+			}
+		},
+	)
+
+	updates := []*Update{
+		{ID: 1, Message: &Message{Chat: Chat{ID: 1}, From: &User{ID: 1}}},
+		{ID: 2, Message: &Message{Chat: Chat{ID: 1}, From: &User{ID: 3, IsBot: true}}},
+		{ID: 3, Message: &Message{Chat: Chat{ID: 3}}},
+		{ID: 4, EditedMessage: &Message{Chat: Chat{ID: 1}}},
+		{ID: 5, Message: &Message{Chat: Chat{ID: 2}}},
+	}
+	for _, u := range updates {
+		d.run(u)
+	}
+
+	if len(values) != 2 || <-values != 1 || <-values != 5 {
+		t.Fatalf("unexpected updates delivered")
+	}
+	if len(created) != 1 || created[0] != 1 {
+		t.Fatalf("expected only session 1 to be created, got %v", created)
+	}
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	errc := make(chan error, 1)
+
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	d.SetErrorHandler(func(err error) { errc <- err })
+	d.Use(func(_ Handler) Handler {
+		return func(_ context.Context, _ *Update) { panic("boom") }
+	})
+	d.run(&Update{ID: 1, Message: &Message{}})
+
+	if err := <-errc; err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -96,8 +96,7 @@ func (c *lclient) SetChatRequestLimit(interval time.Duration, burstSize int) {
 }
 
 // wait blocks until both the per-chat and global rate limiters allow the request.
-func (c *lclient) wait(chatID string) error {
-	ctx := context.Background()
+func (c *lclient) wait(ctx context.Context, chatID string) error {
 	// If the chatID is empty, it's a general API call like GetUpdates, GetMe
 	// and similar, so skip the per-chat request limit wait.
 	if chatID != "" {
@@ -128,7 +127,12 @@ func (c *lclient) wait(chatID string) error {
 
 // dispatch is the common path for all API calls: rate-limit, send, decode, check.
 func (c *lclient) dispatch(chatID string, send func() ([]byte, error), v APIResponse) error {
-	if err := c.wait(chatID); err != nil {
+	return c.dispatchContext(context.Background(), chatID, send, v)
+}
+
+// dispatchContext is like dispatch but stops waiting for the rate limiters when ctx is done.
+func (c *lclient) dispatchContext(ctx context.Context, chatID string, send func() ([]byte, error), v APIResponse) error {
+	if err := c.wait(ctx, chatID); err != nil {
 		return err
 	}
 	cnt, err := send()
@@ -143,7 +147,17 @@ func (c *lclient) dispatch(chatID string, send func() ([]byte, error), v APIResp
 
 // doGet performs a raw HTTP GET and returns the response body.
 func (c *lclient) doGet(reqURL string) ([]byte, error) {
-	resp, err := c.http.Get(reqURL)
+	return c.doGetContext(context.Background(), reqURL)
+}
+
+// doGetContext is like doGet but the request is cancelled when ctx is done.
+func (c *lclient) doGetContext(ctx context.Context, reqURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -239,6 +253,11 @@ func (c *lclient) sendFile(file, thumbnail InputFile, url, fileType string) (res
 
 // get calls a Telegram API endpoint that requires no file upload.
 func (c *lclient) get(base, endpoint string, vals url.Values, v APIResponse) error {
+	return c.getContext(context.Background(), base, endpoint, vals, v)
+}
+
+// getContext is like get but the request is cancelled when ctx is done.
+func (c *lclient) getContext(ctx context.Context, base, endpoint string, vals url.Values, v APIResponse) error {
 	u, err := url.JoinPath(base, endpoint)
 	if err != nil {
 		return err
@@ -250,8 +269,8 @@ func (c *lclient) get(base, endpoint string, vals url.Values, v APIResponse) err
 		}
 	}
 
-	return c.dispatch(vals.Get("chat_id"), func() ([]byte, error) {
-		return c.doGet(u)
+	return c.dispatchContext(ctx, vals.Get("chat_id"), func() ([]byte, error) {
+		return c.doGetContext(ctx, u)
 	}, v)
 }
 
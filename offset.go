@@ -0,0 +1,197 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OffsetStore persists the ID of the last update that has been fully processed,
+// so that the polling loops can resume from it after a restart without
+// dropping nor repeating any update.
+type OffsetStore interface {
+	// Load returns the last saved update ID, or 0 if none has been saved yet.
+	Load() (int, error)
+	// Save stores updateID as the last fully processed update.
+	Save(updateID int) error
+}
+
+// FileOffsetStore is an OffsetStore that keeps the update ID in a file.
+type FileOffsetStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileOffsetStore returns a new FileOffsetStore that saves the update ID in
+// the file at path, which is created on the first call to Save.
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{path: path}
+}
+
+// Load returns the update ID saved in the file, or 0 if the file doesn't exist.
+func (f *FileOffsetStore) Load() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Save writes updateID to the file.
+// The file is replaced atomically so that a crash never leaves it half written.
+func (f *FileOffsetStore) Save(updateID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.Itoa(updateID)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// offsetTracker keeps track of the updates being processed concurrently and
+// saves to the OffsetStore the highest update ID for which the update itself
+// and all the ones received before have been fully processed.
+type offsetTracker struct {
+	store   OffsetStore
+	done    map[int]bool
+	pending []int
+	mu      sync.Mutex
+}
+
+// track starts tracking the updates on behalf of store.
+func (t *offsetTracker) track(store OffsetStore) {
+	t.mu.Lock()
+	t.store = store
+	t.done = make(map[int]bool)
+	t.pending = nil
+	t.mu.Unlock()
+}
+
+// add registers the update with the given ID as received.
+func (t *offsetTracker) add(id int) {
+	t.mu.Lock()
+	if t.store != nil {
+		t.pending = append(t.pending, id)
+		t.done[id] = false
+	}
+	t.mu.Unlock()
+}
+
+// complete marks the update with the given ID as processed and saves the
+// new offset if it moved forward.
+func (t *offsetTracker) complete(id int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Updates not received by the polling loop aren't tracked.
+	if _, ok := t.done[id]; !ok || t.store == nil {
+		return nil
+	}
+
+	t.done[id] = true
+
+	var last int
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		last = t.pending[0]
+		delete(t.done, last)
+		t.pending = t.pending[1:]
+	}
+
+	if last == 0 {
+		return nil
+	}
+	return t.store.Save(last)
+}
+
+// dedupSize is the number of recent update IDs remembered by dedup.
+const dedupSize = 1024
+
+// dedup remembers the IDs of the most recent updates in order to discard the
+// ones delivered more than once, as Telegram does when the webhook fails to
+// acknowledge them in time.
+type dedup struct {
+	// ids maps each remembered ID to its slot in ring.
+	ids  map[int]int
+	ring [dedupSize]int
+	next int
+	full bool
+	mu   sync.Mutex
+}
+
+// seen reports whether id has already been seen, and remembers it otherwise.
+func (d *dedup) seen(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ids == nil {
+		d.ids = make(map[int]int, dedupSize)
+	}
+
+	if _, ok := d.ids[id]; ok {
+		return true
+	}
+
+	// The oldest slot is evicted only if it still holds the ID it was
+	// assigned, which isn't the case if the ID has been forgotten and seen
+	// again meanwhile.
+	if old := d.ring[d.next]; d.full {
+		if slot, ok := d.ids[old]; ok && slot == d.next {
+			delete(d.ids, old)
+		}
+	}
+	d.ids[id] = d.next
+	d.ring[d.next] = id
+	d.next = (d.next + 1) % dedupSize
+	d.full = d.full || d.next == 0
+	return false
+}
+
+// forget removes id from the seen updates, so that it's accepted when it's
+// delivered again.
+func (d *dedup) forget(id int) {
+	d.mu.Lock()
+	delete(d.ids, id)
+	d.mu.Unlock()
+}
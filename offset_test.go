@@ -0,0 +1,150 @@
+package echotron
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type memOffsetStore struct {
+	saved []int
+	mu    sync.Mutex
+}
+
+func (m *memOffsetStore) Load() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.saved) == 0 {
+		return 0, nil
+	}
+	return m.saved[len(m.saved)-1], nil
+}
+
+func (m *memOffsetStore) Save(updateID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.saved = append(m.saved, updateID)
+	return nil
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	store := NewFileOffsetStore(filepath.Join(t.TempDir(), "offset"))
+
+	if offset, err := store.Load(); err != nil || offset != 0 {
+		t.Fatalf("expected 0 from a missing file, got %d %v", offset, err)
+	}
+
+	if err := store.Save(42); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset, err := store.Load(); err != nil || offset != 42 {
+		t.Fatalf("expected 42, got %d %v", offset, err)
+	}
+}
+
+func TestOffsetTracker(t *testing.T) {
+	var (
+		tr    offsetTracker
+		store = &memOffsetStore{}
+	)
+
+	tr.track(store)
+	tr.add(1)
+	tr.add(2)
+	tr.add(3)
+
+	tr.complete(2)
+	if offset, _ := store.Load(); offset != 0 {
+		t.Fatalf("expected nothing saved, got %d", offset)
+	}
+
+	tr.complete(1)
+	tr.complete(4)
+	if offset, _ := store.Load(); offset != 2 {
+		t.Fatalf("expected 2, got %d", offset)
+	}
+
+	tr.complete(3)
+	if offset, _ := store.Load(); offset != 3 {
+		t.Fatalf("expected 3, got %d", offset)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	var d dedup
+
+	if d.seen(1) {
+		t.Fatal("update 1 not seen yet")
+	}
+	if !d.seen(1) {
+		t.Fatal("update 1 already seen")
+	}
+
+	for i := 2; i <= dedupSize+1; i++ {
+		d.seen(i)
+	}
+	if d.seen(1) {
+		t.Fatal("update 1 should have been forgotten")
+	}
+}
+
+func TestDedupForget(t *testing.T) {
+	var d dedup
+
+	d.seen(1)
+	d.seen(2)
+	d.forget(1)
+	if d.seen(1) {
+		t.Fatal("update 1 should have been forgotten")
+	}
+
+	for i := 3; i <= 10*dedupSize; i++ {
+		d.seen(i)
+	}
+	if len(d.ids) != dedupSize {
+		t.Fatalf("expected %d remembered IDs, got %d", dedupSize, len(d.ids))
+	}
+	if !d.seen(10 * dedupSize) {
+		t.Fatal("the most recent update should be remembered")
+	}
+}
+
+func TestOffsetAfterShutdown(t *testing.T) {
+	var (
+		store   = &memOffsetStore{}
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) {
+			if u.ID == 1 {
+				close(started)
+				<-release
+			}
+		})
+	})
+	d.SetConcurrency(1)
+	d.SetQueue(1, OverflowBlock)
+	d.offsets.track(store)
+
+	for id := 1; id <= 2; id++ {
+		d.offsets.add(id)
+		d.push(context.Background(), &Update{ID: id, Message: &Message{Chat: Chat{ID: int64(id)}}}, false)
+	}
+	<-started
+	d.Shutdown()
+	close(release)
+
+	waitFor(t, func() bool {
+		s := d.Stats()
+		return s.Queued == 0 && s.Active == 0
+	})
+	if offset, _ := store.Load(); offset != 1 {
+		t.Fatalf("expected the offset of the last delivered update 1, got %d", offset)
+	}
+}
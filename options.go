@@ -101,19 +101,29 @@ type UpdateType string
 
 // These are all the possible types that a bot can be subscribed to.
 const (
-	MessageUpdate            UpdateType = "message"
-	EditedMessageUpdate                 = "edited_message"
-	ChannelPostUpdate                   = "channel_post"
-	EditedChannelPostUpdate             = "edited_channel_post"
-	InlineQueryUpdate                   = "inline_query"
-	ChosenInlineResultUpdate            = "chosen_inline_result"
-	CallbackQueryUpdate                 = "callback_query"
-	ShippingQueryUpdate                 = "shipping_query"
-	PreCheckoutQueryUpdate              = "pre_checkout_query"
-	PollUpdate                          = "poll"
-	PollAnswerUpdate                    = "poll_answer"
-	MyChatMemberUpdate                  = "my_chat_member"
-	ChatMemberUpdate                    = "chat_member"
+	MessageUpdate                 UpdateType = "message"
+	EditedMessageUpdate                      = "edited_message"
+	ChannelPostUpdate                        = "channel_post"
+	EditedChannelPostUpdate                  = "edited_channel_post"
+	InlineQueryUpdate                        = "inline_query"
+	ChosenInlineResultUpdate                 = "chosen_inline_result"
+	CallbackQueryUpdate                      = "callback_query"
+	ShippingQueryUpdate                      = "shipping_query"
+	PreCheckoutQueryUpdate                   = "pre_checkout_query"
+	PollUpdate                               = "poll"
+	PollAnswerUpdate                         = "poll_answer"
+	MyChatMemberUpdate                       = "my_chat_member"
+	ChatMemberUpdate                         = "chat_member"
+	ChatJoinRequestUpdate                    = "chat_join_request"
+	MessageReactionUpdate                    = "message_reaction"
+	MessageReactionCountUpdate               = "message_reaction_count"
+	ChatBoostUpdate                          = "chat_boost"
+	RemovedChatBoostUpdate                   = "removed_chat_boost"
+	BusinessConnectionUpdate                 = "business_connection"
+	BusinessMessageUpdate                    = "business_message"
+	EditedBusinessMessageUpdate              = "edited_business_message"
+	DeletedBusinessMessagesUpdate            = "deleted_business_messages"
+	PurchasedPaidMediaUpdate                 = "purchased_paid_media"
 )
 
 // ReplyMarkup is an interface for the various keyboard types.
@@ -234,7 +244,11 @@ type ForceReply struct {
 func (f ForceReply) ImplementsReplyMarkup() {}
 
 // UpdateOptions contains the optional parameters used by the GetUpdates method.
+// OffsetStore isn't sent to Telegram: when set, the polling loops of Dispatcher
+// and PollingUpdatesOptions use it to persist the last processed update and to
+// resume from it on the next start.
 type UpdateOptions struct {
+	OffsetStore    OffsetStore
 	AllowedUpdates []UpdateType `query:"allowed_updates"`
 	Offset         int          `query:"offset"`
 	Limit          int          `query:"limit"`
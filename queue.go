@@ -0,0 +1,157 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// OverflowPolicy is a custom type for the various behaviours of the Dispatcher
+// when its update queue is full.
+type OverflowPolicy int
+
+// These are all the possible overflow policies.
+const (
+	// OverflowBlock makes the producer of the update wait until there's room
+	// in the queue, slowing down the polling loop or the webhook response.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest update in the queue to make room
+	// for the new one.
+	OverflowDropOldest
+	// OverflowReject refuses the new update: in webhook mode HandleWebhook
+	// responds with 503 so that Telegram delivers it again later.
+	// Since updates received by polling can't be delivered again, in polling
+	// mode OverflowReject behaves like OverflowBlock.
+	OverflowReject
+)
+
+// DispatcherStats contains the metrics of the update queue of a Dispatcher.
+type DispatcherStats struct {
+	// Queued is the number of updates waiting in the queue.
+	Queued int
+	// Capacity is the size of the queue.
+	Capacity int
+	// Active is the number of updates being processed.
+	Active int64
+	// Dropped is the number of updates discarded by OverflowDropOldest.
+	Dropped uint64
+	// Rejected is the number of updates refused by OverflowReject.
+	Rejected uint64
+}
+
+// errQueueFull is returned by push when an update is rejected.
+var errQueueFull = errors.New("echotron: update queue full")
+
+// SetConcurrency limits to n the number of updates processed at the same time.
+// A value of 0, which is the default, spawns a goroutine for every update.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) SetConcurrency(n int) {
+	d.workers = n
+}
+
+// SetQueue sets the size of the queue that holds the updates waiting to be
+// processed and the policy to apply when it's full.
+// The default is an unbuffered queue with OverflowBlock.
+// The size is at least 1 for the policies other than OverflowBlock.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) SetQueue(size int, policy OverflowPolicy) {
+	if policy != OverflowBlock && size < 1 {
+		size = 1
+	}
+	d.queueSize = size
+	d.policy = policy
+}
+
+// Stats returns the current metrics of the update queue.
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.startOnce.Do(d.start)
+
+	return DispatcherStats{
+		Queued:   len(d.queue),
+		Capacity: cap(d.queue),
+		Active:   atomic.LoadInt64(&d.active),
+		Dropped:  atomic.LoadUint64(&d.dropped),
+		Rejected: atomic.LoadUint64(&d.rejected),
+	}
+}
+
+// start creates the queue and the goroutines that consume it.
+func (d *Dispatcher) start() {
+	d.queue = make(chan *Update, d.queueSize)
+
+	if d.workers <= 0 {
+		go func() {
+			for update := range d.queue {
+				go d.run(update)
+			}
+		}()
+		return
+	}
+
+	for i := 0; i < d.workers; i++ {
+		go func() {
+			for update := range d.queue {
+				d.run(update)
+			}
+		}()
+	}
+}
+
+// push adds update to the queue applying the overflow policy.
+// If canReject is false, OverflowReject behaves like OverflowBlock.
+func (d *Dispatcher) push(ctx context.Context, update *Update, canReject bool) error {
+	d.startOnce.Do(d.start)
+
+	switch {
+	case d.policy == OverflowDropOldest:
+		for {
+			select {
+			case d.queue <- update:
+				return nil
+			default:
+			}
+
+			select {
+			case old := <-d.queue:
+				atomic.AddUint64(&d.dropped, 1)
+				d.complete(old)
+			default:
+			}
+		}
+
+	case d.policy == OverflowReject && canReject:
+		select {
+		case d.queue <- update:
+			return nil
+		default:
+			atomic.AddUint64(&d.rejected, 1)
+			return errQueueFull
+		}
+
+	default:
+		select {
+		case d.queue <- update:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package echotron
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	var (
+		active  int32
+		maxSeen int32
+		done    = make(chan struct{}, 10)
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(_ *Update) {
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&maxSeen)
+				if n <= m || atomic.CompareAndSwapInt32(&maxSeen, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			done <- struct{}{}
+		})
+	})
+	d.SetConcurrency(2)
+	d.SetQueue(10, OverflowBlock)
+
+	for i := 0; i < 10; i++ {
+		d.push(context.Background(), &Update{ID: i, Message: &Message{Chat: Chat{ID: int64(i)}}}, false)
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	if maxSeen > 2 {
+		t.Fatalf("expected at most 2 concurrent updates, got %d", maxSeen)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	var (
+		block = make(chan struct{})
+		seen  = make(chan int, 10)
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(u *Update) {
+			<-block
+			seen <- u.ID
+		})
+	})
+	d.SetConcurrency(1)
+	d.SetQueue(2, OverflowDropOldest)
+
+	d.push(context.Background(), &Update{ID: 1, Message: &Message{}}, false)
+	// Wait for the worker to pick up the first update.
+	for d.Stats().Active != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 2; i <= 5; i++ {
+		d.push(context.Background(), &Update{ID: i, Message: &Message{}}, false)
+	}
+
+	if s := d.Stats(); s.Dropped != 2 || s.Queued != 2 || s.Capacity != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	close(block)
+	for _, expected := range []int{1, 4, 5} {
+		if id := <-seen; id != expected {
+			t.Fatalf("expected update %d, got %d", expected, id)
+		}
+	}
+}
+
+func TestOverflowReject(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(_ *Update) { <-block })
+	})
+	d.SetConcurrency(1)
+	d.SetQueue(1, OverflowReject)
+
+	codes := make([]int, 3)
+	for i := range codes {
+		body := fmt.Sprintf(`{"update_id":%d,"message":{"chat":{"id":1}}}`, i+1)
+		rec := httptest.NewRecorder()
+		d.HandleWebhook(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		codes[i] = rec.Code
+
+		// Wait for the worker to pick up the first update.
+		for i == 0 && d.Stats().Active != 1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status codes %v", codes)
+	}
+
+	if s := d.Stats(); s.Rejected != 1 {
+		t.Fatalf("expected 1 rejected update, got %d", s.Rejected)
+	}
+
+	// The rejected update must be accepted when Telegram delivers it again.
+	if d.recent.seen(3) {
+		t.Fatal("rejected update marked as seen")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Mode is the way the Dispatcher receives the updates from Telegram.
+type Mode int32
+
+// These are the modes a Dispatcher can be served in.
+const (
+	PollingMode Mode = iota
+	WebhookMode
+)
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	switch m {
+	case PollingMode:
+		return "polling"
+	case WebhookMode:
+		return "webhook"
+	default:
+		return fmt.Sprintf("Mode(%d)", int32(m))
+	}
+}
+
+// ServeOptions contains the parameters used by Dispatcher.Serve.
+type ServeOptions struct {
+	// Webhook contains the options passed to SetWebhook in webhook mode.
+	Webhook *WebhookOptions
+	// WebhookURL is the url of the webhook, in the same format accepted by
+	// ListenWebhookOptions, eg: 'https://example.com:443/bot_token'.
+	WebhookURL string
+	// Polling contains the options used in polling mode.
+	Polling UpdateOptions
+	// FallbackErrors is the number of consecutive checks of GetWebhookInfo
+	// reporting a new delivery error after which the Dispatcher falls back to
+	// polling. 0 disables the watchdog.
+	FallbackErrors int
+	// WatchdogInterval is the interval between two checks of GetWebhookInfo,
+	// one minute if 0.
+	WatchdogInterval time.Duration
+}
+
+// Serve receives the updates in the given mode until ctx is done or an error
+// that can't be solved by retrying occurs, while SwitchMode moves it from one
+// mode to the other without losing the sessions nor the updates.
+// In both modes the transient errors of Telegram, including the ones setting
+// the webhook, are retried with an exponential backoff.
+// In webhook mode, when opts.FallbackErrors is set, a watchdog checks the
+// delivery errors reported by GetWebhookInfo and falls back to polling if they
+// keep happening.
+// Unlike ListenWebhookOptions, Serve runs its own webserver listening on the
+// port of opts.WebhookURL, which is stopped when leaving the webhook mode.
+func (d *Dispatcher) Serve(ctx context.Context, mode Mode, opts ServeOptions) error {
+	d.mu.Lock()
+	if d.modec != nil {
+		d.mu.Unlock()
+		return errors.New("echotron: dispatcher already serving")
+	}
+	d.modec = make(chan Mode, 1)
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.modec = nil
+		d.mu.Unlock()
+	}()
+
+	for {
+		atomic.StoreInt32(&d.mode, int32(mode))
+
+		runCtx, cancel := context.WithCancel(ctx)
+		errc := make(chan error, 1)
+		go func(mode Mode) {
+			errc <- d.serveMode(runCtx, mode, opts)
+		}(mode)
+
+		select {
+		case next := <-d.modec:
+			cancel()
+			<-errc
+			if next != mode {
+				log.Println("echotron.Dispatcher", "Serve", "switching to", next, "mode")
+			}
+			mode = next
+
+		case err := <-errc:
+			cancel()
+			return err
+		}
+	}
+}
+
+// SwitchMode makes the Dispatcher served with Serve receive the updates in the
+// given mode from now on.
+// It has no effect if the Dispatcher isn't being served with Serve.
+func (d *Dispatcher) SwitchMode(mode Mode) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.modec == nil {
+		return
+	}
+
+	// Only the last requested mode matters.
+	select {
+	case <-d.modec:
+	default:
+	}
+	d.modec <- mode
+}
+
+// Mode returns the current mode of the Dispatcher served with Serve.
+func (d *Dispatcher) Mode() Mode {
+	return Mode(atomic.LoadInt32(&d.mode))
+}
+
+// serveMode receives the updates in the given mode until ctx is done.
+func (d *Dispatcher) serveMode(ctx context.Context, mode Mode, opts ServeOptions) error {
+	if mode == PollingMode {
+		return d.PollContext(ctx, false, opts.Polling)
+	}
+	return d.serveWebhook(ctx, opts)
+}
+
+// serveWebhook sets the webhook and serves it until ctx is done.
+func (d *Dispatcher) serveWebhook(ctx context.Context, opts ServeOptions) error {
+	u, err := url.Parse(opts.WebhookURL)
+	if err != nil {
+		return err
+	}
+
+	var bo backoff
+	whOpts := d.webhookOptions(opts.Webhook)
+	whURL := fmt.Sprintf("%s%s", u.Hostname(), u.EscapedPath())
+	// Transient errors are retried like in PollContext, so that they don't
+	// stop the Dispatcher.
+	for {
+		_, err := d.api.SetWebhook(whURL, false, whOpts)
+		if err == nil {
+			break
+		}
+		log.Println("echotron.Dispatcher", "Serve", err)
+		if err := bo.retry(ctx, err); err != nil {
+			return err
+		}
+	}
+	if whOpts != nil {
+		d.SetSecretToken(whOpts.SecretToken)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(u.EscapedPath(), d.HandleWebhook)
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", u.Port()), Handler: mux}
+
+	if opts.FallbackErrors > 0 {
+		go d.watchdog(ctx, opts)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if serr := srv.Shutdown(context.Background()); serr != nil && !errors.Is(serr, http.ErrServerClosed) {
+		log.Println("echotron.Dispatcher", "Serve", serr)
+	}
+	return err
+}
+
+// watchdog switches the Dispatcher to polling mode after opts.FallbackErrors
+// consecutive checks of GetWebhookInfo reporting a new delivery error.
+func (d *Dispatcher) watchdog(ctx context.Context, opts ServeOptions) {
+	var failures int
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := WebhookMonitor{
+		API:      d.api,
+		Interval: opts.WatchdogInterval,
+		OnEvent: func(e WebhookEvent) {
+			switch e.Type {
+			case WebhookDeliveryError:
+				log.Println("echotron.Dispatcher", "watchdog", e.Info.LastErrorMessage)
+				if failures++; failures >= opts.FallbackErrors {
+					d.SwitchMode(PollingMode)
+					cancel()
+				}
+			case WebhookRecovered:
+				failures = 0
+			case WebhookCheckFailed:
+				log.Println("echotron.Dispatcher", "watchdog", e.Err)
+			}
+		},
+	}
+	m.Run(ctx)
+}
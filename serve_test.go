@@ -0,0 +1,118 @@
+package echotron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeFallback(t *testing.T) {
+	var (
+		webhooks  int32
+		polls     int32
+		errorDate int64
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	d.api = fakeAPI(t, func(method string, _ *http.Request) string {
+		switch method {
+		case "setWebhook":
+			atomic.AddInt32(&webhooks, 1)
+		case "getUpdates":
+			atomic.AddInt32(&polls, 1)
+			time.Sleep(time.Millisecond)
+			return `{"ok":true,"result":[]}`
+		case "getWebhookInfo":
+			// Every check reports a new delivery error.
+			date := atomic.AddInt64(&errorDate, 1)
+			return fmt.Sprintf(`{"ok":true,"result":{"last_error_date":%d,"last_error_message":"Connection refused"}}`, date)
+		}
+		return `{"ok":true}`
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	whURL := fmt.Sprintf("https://example.com:%d/hook", freePort(t))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Serve(ctx, WebhookMode, ServeOptions{
+			WebhookURL:       whURL,
+			FallbackErrors:   2,
+			WatchdogInterval: 5 * time.Millisecond,
+		})
+	}()
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&polls) > 0 })
+	if m := d.Mode(); m != PollingMode {
+		t.Fatalf("expected polling mode, got %s", m)
+	}
+
+	d.SwitchMode(WebhookMode)
+	waitFor(t, func() bool { return atomic.LoadInt32(&webhooks) == 2 })
+
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestServeWebhookRetry(t *testing.T) {
+	var webhooks int32
+
+	fastRetries(t)
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	d.api = fakeAPI(t, func(method string, _ *http.Request) string {
+		if method == "setWebhook" && atomic.AddInt32(&webhooks, 1) < 3 {
+			return `{"ok":false,"error_code":502,"description":"Bad Gateway"}`
+		}
+		return `{"ok":true}`
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	whURL := fmt.Sprintf("https://example.com:%d/hook", freePort(t))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Serve(ctx, WebhookMode, ServeOptions{WebhookURL: whURL})
+	}()
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&webhooks) == 3 })
+	select {
+	case err := <-errc:
+		t.Fatalf("Serve returned after a transient error: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// ProcessUpdate processes update synchronously: it passes it through the
+// middlewares, looks up or creates its session, restoring its state from the
+// SessionStore, and returns once the Bot has processed it and its state has
+// been saved.
+// The state is restored on every call, even if the session is already live,
+// so that the warm instances of a serverless function sharing the same store
+// don't work on stale state.
+// Unlike the other ways of feeding the Dispatcher, ProcessUpdate doesn't use
+// the queue nor spawns goroutines, so it's suitable for serverless platforms,
+// where the process may be frozen as soon as the response is sent.
+// The errors returned by the Bot, its panics and the errors of the SessionStore
+// are returned as *UpdateError instead of being reported to the error handler.
+func (d *Dispatcher) ProcessUpdate(ctx context.Context, update *Update) error {
+	var err error
+
+	if d.isClosed() {
+		return errDispatcherClosed
+	}
+
+	atomic.AddInt64(&d.active, 1)
+	defer atomic.AddInt64(&d.active, -1)
+	// The update stays pending if the Dispatcher is shut down meanwhile.
+	defer func() {
+		if !errors.Is(err, errDispatcherClosed) {
+			d.complete(update)
+		}
+	}()
+
+	h := d.chain(func(ctx context.Context, u *Update) {
+		err = d.process(u, func(bot Bot) error {
+			if key, ok := d.sessionKey(u); ok {
+				if err := d.restore(key, bot); err != nil {
+					return err
+				}
+			}
+			return callBot(ctx, bot, u)
+		})
+	})
+
+	// Recover the panics of the middlewares as well.
+	chatID, _ := update.ChatID()
+	if perr := protect(chatID, update, func() error {
+		h(ctx, update)
+		return nil
+	}); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// ServerlessHandler returns an http.Handler that reads the update sent by
+// Telegram to the webhook and processes it with ProcessUpdate before answering.
+// Requests are validated like in HandleWebhook, and if ProcessUpdate fails
+// the handler answers with a 500 status code, so that Telegram delivers the
+// update again.
+func (d *Dispatcher) ServerlessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		update, code, err := readUpdate(w, r, d.secret())
+		if err != nil {
+			log.Println("echotron.Dispatcher", "ServerlessHandler", err)
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+
+		if err := d.ProcessUpdate(r.Context(), update); err != nil {
+			log.Println("echotron.Dispatcher", "ServerlessHandler", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,115 @@
+package echotron
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type counterBot struct {
+	count int
+}
+
+func (c *counterBot) Update(u *Update) {
+	if u.Message.Text == "panic" {
+		panic("boom")
+	}
+	c.count++
+}
+
+func (c *counterBot) MarshalBinary() ([]byte, error) {
+	return []byte(strconv.Itoa(c.count)), nil
+}
+
+func (c *counterBot) UnmarshalBinary(b []byte) (err error) {
+	c.count, err = strconv.Atoi(string(b))
+	return
+}
+
+func TestProcessUpdate(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each Dispatcher simulates a new invocation of a serverless function.
+	var bot *counterBot
+	for i := 1; i <= 3; i++ {
+		d := NewDispatcher("token", func(_ int64) Bot {
+			bot = &counterBot{}
+			return bot
+		})
+		d.SetSessionStore(store)
+
+		if err := d.ProcessUpdate(context.Background(), &Update{ID: i, Message: &Message{Chat: Chat{ID: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+		if bot.count != i {
+			t.Fatalf("expected count %d, got %d", i, bot.count)
+		}
+	}
+
+	d := NewDispatcher("token", func(_ int64) Bot { return &counterBot{} })
+	d.SetSessionStore(store)
+
+	var uerr *UpdateError
+	err = d.ProcessUpdate(context.Background(), &Update{ID: 4, Message: &Message{Chat: Chat{ID: 1}, Text: "panic"}})
+	if !errors.As(err, &uerr) || uerr.Stack == nil {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+
+	if state, _ := store.Load(1); string(state) != "3" {
+		t.Fatalf("expected state 3, got %q", state)
+	}
+
+	store.Save(2, []byte("invalid"))
+	if err := d.ProcessUpdate(context.Background(), &Update{ID: 5, Message: &Message{Chat: Chat{ID: 2}}}); !errors.As(err, &uerr) {
+		t.Fatalf("expected restore error, got %v", err)
+	}
+	if _, ok := d.Session(2); ok {
+		t.Fatal("session created despite the restore error")
+	}
+}
+
+func TestProcessUpdateWarmInstances(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two warm instances sharing the store handle the updates alternately.
+	newInstance := func() *Dispatcher {
+		d := NewDispatcher("token", func(_ int64) Bot { return &counterBot{} })
+		d.SetSessionStore(store)
+		return d
+	}
+	a, b := newInstance(), newInstance()
+
+	for i, d := range []*Dispatcher{a, b, a} {
+		if err := d.ProcessUpdate(context.Background(), &Update{ID: i, Message: &Message{Chat: Chat{ID: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if state, _ := store.Load(1); string(state) != "3" {
+		t.Fatalf("expected count 3, got %s", state)
+	}
+}
+
+func TestServerlessHandler(t *testing.T) {
+	d := NewDispatcher("token", func(_ int64) Bot { return &counterBot{} })
+	h := d.ServerlessHandler()
+
+	for text, code := range map[string]int{"hello": http.StatusOK, "panic": http.StatusInternalServerError} {
+		body := `{"update_id":1,"message":{"chat":{"id":1},"text":"` + text + `"}}`
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if rec.Code != code {
+			t.Fatalf("%s: expected status %d, got %d", text, code, rec.Code)
+		}
+	}
+}
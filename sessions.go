@@ -0,0 +1,93 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import "sync"
+
+// EventReceiver is implemented by the bots that can receive the events sent
+// with Dispatcher.Broadcast.
+type EventReceiver interface {
+	Event(event any)
+}
+
+// Session returns the Bot of the session associated with chatID, if any.
+func (d *Dispatcher) Session(chatID int64) (Bot, bool) {
+	return d.sessions.load(chatID)
+}
+
+// SessionCount returns the number of live sessions.
+func (d *Dispatcher) SessionCount() (n int) {
+	d.sessions.rangeAll(func(_ int64, _ Bot) bool {
+		n++
+		return true
+	})
+	return
+}
+
+// RangeSessions calls fn for each live session, stopping if fn returns false.
+// Sessions created or deleted during the iteration may or may not be visited,
+// and fn is allowed to call any method of the Dispatcher.
+func (d *Dispatcher) RangeSessions(fn func(chatID int64, bot Bot) bool) {
+	d.sessions.rangeAll(fn)
+}
+
+// Broadcast delivers event to every live session whose Bot implements
+// EventReceiver and, if filter isn't nil, for which filter returns true.
+// The events are delivered concurrently, to at most as many Bots at a time as
+// set with SetConcurrency, and Broadcast returns once every Bot has received
+// its own, reporting how many did.
+// Panics raised by the bots are reported to the error handler.
+func (d *Dispatcher) Broadcast(event any, filter func(chatID int64, bot Bot) bool) int {
+	var (
+		n   int
+		wg  sync.WaitGroup
+		sem chan struct{}
+	)
+
+	if d.workers > 0 {
+		sem = make(chan struct{}, d.workers)
+	}
+
+	d.sessions.rangeAll(func(chatID int64, bot Bot) bool {
+		r, ok := unwrapBot(bot).(EventReceiver)
+		if !ok || (filter != nil && !filter(chatID, bot)) {
+			return true
+		}
+
+		n++
+		wg.Add(1)
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		go func() {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			d.guard(chatID, nil, func() error {
+				r.Event(event)
+				return nil
+			})
+		}()
+		return true
+	})
+
+	wg.Wait()
+	return n
+}
@@ -0,0 +1,126 @@
+package echotron
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type eventBot struct {
+	mu     *sync.Mutex
+	events map[int64]any
+	chatID int64
+}
+
+func (e eventBot) Update(_ *Update) {}
+
+func (e eventBot) Event(event any) {
+	if event == "panic" {
+		panic(event)
+	}
+
+	e.mu.Lock()
+	e.events[e.chatID] = event
+	e.mu.Unlock()
+}
+
+func TestSessions(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events = make(map[int64]any)
+	)
+
+	d := NewDispatcher("token", func(chatID int64) Bot {
+		if chatID == 4 {
+			return test{}
+		}
+		return eventBot{&mu, events, chatID}
+	})
+	for i := int64(1); i <= 4; i++ {
+		d.AddSession(i)
+	}
+
+	if n := d.SessionCount(); n != 4 {
+		t.Fatalf("expected 4 sessions, got %d", n)
+	}
+	if _, ok := d.Session(3); !ok {
+		t.Fatal("session 3 not found")
+	}
+	if _, ok := d.Session(5); ok {
+		t.Fatal("unexpected session 5")
+	}
+
+	var visited int
+	d.RangeSessions(func(_ int64, _ Bot) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("expected iteration to stop after 1 session, visited %d", visited)
+	}
+
+	n := d.Broadcast("maintenance", func(chatID int64, _ Bot) bool {
+		return chatID != 1
+	})
+	if n != 2 || len(events) != 2 || events[2] != "maintenance" || events[3] != "maintenance" {
+		t.Fatalf("unexpected delivery to %d sessions: %v", n, events)
+	}
+}
+
+func TestBroadcastPanic(t *testing.T) {
+	errc := make(chan error, 1)
+
+	d := NewDispatcher("token", func(chatID int64) Bot {
+		return eventBot{chatID: chatID}
+	})
+	d.SetErrorHandler(func(err error) { errc <- err })
+	d.AddSession(7)
+
+	if n := d.Broadcast("panic", nil); n != 1 {
+		t.Fatalf("expected 1 delivery, got %d", n)
+	}
+
+	var uerr *UpdateError
+	if err := <-errc; !errors.As(err, &uerr) || uerr.ChatID != 7 || uerr.Update != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+type slowEventBot struct {
+	active, max *int32
+}
+
+func (s slowEventBot) Update(_ *Update) {}
+
+func (s slowEventBot) Event(_ any) {
+	n := atomic.AddInt32(s.active, 1)
+	for {
+		m := atomic.LoadInt32(s.max)
+		if n <= m || atomic.CompareAndSwapInt32(s.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	atomic.AddInt32(s.active, -1)
+}
+
+func TestBroadcastConcurrency(t *testing.T) {
+	var active, max int32
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return slowEventBot{&active, &max}
+	})
+	d.SetConcurrency(3)
+	for i := int64(0); i < 30; i++ {
+		d.AddSession(i)
+	}
+
+	if n := d.Broadcast("event", nil); n != 30 {
+		t.Fatalf("expected 30 deliveries, got %d", n)
+	}
+	if max > 3 {
+		t.Fatalf("expected at most 3 concurrent deliveries, got %d", max)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"encoding"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SessionStore persists the state of the sessions, so that it survives the
+// restarts of the process.
+// The Dispatcher restores the state of the Bots implementing
+// encoding.BinaryUnmarshaler when their session is created, and saves the
+// state of the ones implementing encoding.BinaryMarshaler after each update.
+type SessionStore interface {
+	// Load returns the state saved for the session of chatID, or nil if none
+	// has been saved yet.
+	Load(chatID int64) ([]byte, error)
+	// Save stores the state of the session of chatID.
+	Save(chatID int64, state []byte) error
+}
+
+// FileSessionStore is a SessionStore that keeps the state of each session in
+// a file of its directory.
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore returns a new FileSessionStore that saves the states in
+// dir, which is created if it doesn't exist.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+// Load returns the content of the file of the session, or nil if it doesn't exist.
+func (f *FileSessionStore) Load(chatID int64) ([]byte, error) {
+	b, err := os.ReadFile(f.path(chatID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// Save writes state to the file of the session.
+// The file is replaced atomically so that a crash never leaves it half written.
+func (f *FileSessionStore) Save(chatID int64, state []byte) error {
+	path := f.path(chatID)
+
+	tmp, err := os.CreateTemp(f.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(state); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete removes the file of the session.
+func (f *FileSessionStore) Delete(chatID int64) error {
+	err := os.Remove(f.path(chatID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *FileSessionStore) path(chatID int64) string {
+	return filepath.Join(f.dir, strconv.FormatInt(chatID, 10))
+}
+
+// SetSessionStore sets the SessionStore in which the Dispatcher persists the
+// state of the sessions.
+// Removing a session with DelSession doesn't delete its state from s.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) SetSessionStore(s SessionStore) {
+	d.store = s
+}
+
+// restore loads the saved state of the session of chatID into bot.
+func (d *Dispatcher) restore(chatID int64, bot Bot) error {
+	u, ok := unwrapBot(bot).(encoding.BinaryUnmarshaler)
+	if d.store == nil || !ok {
+		return nil
+	}
+
+	state, err := d.store.Load(chatID)
+	if err != nil || state == nil {
+		return err
+	}
+	return u.UnmarshalBinary(state)
+}
+
+// save stores the state of bot as the one of the session of chatID.
+func (d *Dispatcher) save(chatID int64, bot Bot) error {
+	m, ok := unwrapBot(bot).(encoding.BinaryMarshaler)
+	if d.store == nil || !ok {
+		return nil
+	}
+
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return d.store.Save(chatID, state)
+}
@@ -0,0 +1,211 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Transport delivers the updates received by a sharded Dispatcher to one of
+// the worker Dispatchers that process them.
+type Transport interface {
+	Deliver(ctx context.Context, update *Update) error
+}
+
+// HTTPTransport is a Transport that posts the updates to the webhook handler of
+// a worker Dispatcher, as Telegram would.
+type HTTPTransport struct {
+	url         string
+	secretToken string
+	client      *http.Client
+}
+
+// NewHTTPTransport returns a new HTTPTransport that delivers the updates to url,
+// where the worker Dispatcher serves HandleWebhook.
+// If secretToken isn't empty, it's sent in the X-Telegram-Bot-Api-Secret-Token
+// header and must match the one set with SetSecretToken on the worker.
+func NewHTTPTransport(url, secretToken string) *HTTPTransport {
+	return &HTTPTransport{
+		url:         url,
+		secretToken: secretToken,
+		client:      &http.Client{Timeout: deliveryTimeout},
+	}
+}
+
+// Deliver posts update to the worker and returns an error if it doesn't
+// acknowledge it with a 2xx status code.
+func (h *HTTPTransport) Deliver(ctx context.Context, update *Update) error {
+	b, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.secretToken != "" {
+		req.Header.Set(secretTokenHeader, h.secretToken)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("echotron: update %d rejected by %s: %s", update.ID, h.url, res.Status)
+	}
+	return nil
+}
+
+// LocalTransport is a Transport that hands the updates to a Dispatcher running
+// in the same process, useful in tests and to run the front-end and some of
+// the workers together.
+type LocalTransport struct {
+	d *Dispatcher
+}
+
+// NewLocalTransport returns a new LocalTransport that delivers the updates to d.
+func NewLocalTransport(d *Dispatcher) LocalTransport {
+	return LocalTransport{d}
+}
+
+// Deliver queues update on the Dispatcher, failing if it has been shut down or
+// if its queue is full and its overflow policy is OverflowReject.
+func (l LocalTransport) Deliver(ctx context.Context, update *Update) error {
+	if l.d.isClosed() {
+		return errDispatcherClosed
+	}
+	if l.d.recent.seen(update.ID) {
+		return nil
+	}
+
+	if err := l.d.push(ctx, update, true); err != nil {
+		l.d.recent.forget(update.ID)
+		return err
+	}
+	return nil
+}
+
+// shardReplicas is the number of points each shard has on the hash ring.
+const shardReplicas = 128
+
+// deliveryTimeout is the timeout of the requests of HTTPTransport.
+const deliveryTimeout = 30 * time.Second
+
+// deliveryAttempts is the number of times a sharded Dispatcher tries to
+// deliver an update before reporting the error.
+const deliveryAttempts = 5
+
+// hashRing maps the session keys to the shards by consistent hashing, so that
+// adding or removing a shard moves only the sessions of that shard.
+type hashRing struct {
+	points []uint32
+	shards map[uint32]Bot
+}
+
+// newHashRing returns a hashRing over the given shards, identified by name.
+func newHashRing(shards map[string]Transport) hashRing {
+	r := hashRing{shards: make(map[uint32]Bot, len(shards)*shardReplicas)}
+
+	for name, t := range shards {
+		bot := Fallible(shard{t})
+		for i := 0; i < shardReplicas; i++ {
+			p := hash(name + "#" + strconv.Itoa(i))
+			r.points = append(r.points, p)
+			r.shards[p] = bot
+		}
+	}
+	sort.Slice(r.points, func(a, b int) bool {
+		return r.points[a] < r.points[b]
+	})
+	return r
+}
+
+// get returns the shard responsible for the session with the given key.
+func (r hashRing) get(key int64) Bot {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hash(strconv.FormatInt(key, 10))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[r.points[i]]
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// shard is the Bot through which a sharded Dispatcher forwards the updates
+// to a worker.
+type shard struct {
+	transport Transport
+}
+
+// Update delivers the update to the worker, retrying with a backoff.
+func (s shard) Update(update *Update) (err error) {
+	var bo backoff
+
+	for i := 0; i < deliveryAttempts; i++ {
+		if err = s.transport.Deliver(context.Background(), update); err == nil {
+			return nil
+		}
+		bo.wait(context.Background(), err)
+	}
+	return err
+}
+
+// NewShardedDispatcher returns a front-end Dispatcher that, instead of running
+// bots, forwards each update it receives to one of the given worker shards,
+// identified by name.
+// Updates are assigned by consistent hashing of their session key, that is the
+// value returned by Update.ChatID or the update ID for the updates without a
+// chat, so that all the updates of a chat land on the same worker, and adding
+// or removing a shard moves only a fraction of the chats.
+// The front-end receives the updates with any of the polling and webhook
+// methods, and its queue, offset store and journal apply to the forwarding:
+// an update counts as processed once a worker has acknowledged it.
+// Errors delivering an update are reported to the error handler after
+// a few attempts.
+// The front-end has no sessions of its own: AddSession does nothing on it and
+// the sessions live on the workers.
+func NewShardedDispatcher(token string, shards map[string]Transport) *Dispatcher {
+	d := NewDispatcher(token, nil)
+	d.ring = newHashRing(shards)
+	return d
+}
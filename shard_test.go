@@ -0,0 +1,114 @@
+package echotron
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type nopTransport struct{ name string }
+
+func (nopTransport) Deliver(_ context.Context, _ *Update) error { return nil }
+
+func shardName(b Bot) string {
+	return unwrapBot(b).(shard).transport.(*nopTransport).name
+}
+
+func TestHashRing(t *testing.T) {
+	shards := map[string]Transport{
+		"a": &nopTransport{"a"},
+		"b": &nopTransport{"b"},
+		"c": &nopTransport{"c"},
+	}
+	ring := newHashRing(shards)
+	delete(shards, "c")
+	smaller := newHashRing(shards)
+
+	counts := make(map[string]int)
+	for key := int64(0); key < 1000; key++ {
+		name := shardName(ring.get(key))
+		counts[name]++
+
+		if shardName(ring.get(key)) != name {
+			t.Fatalf("key %d mapped to different shards", key)
+		}
+		// Removing a shard must move only the keys it owned.
+		if name != "c" && shardName(smaller.get(key)) != name {
+			t.Fatalf("key %d moved from %s", key, name)
+		}
+	}
+
+	if len(counts) != 3 {
+		t.Fatalf("expected keys on 3 shards, got %v", counts)
+	}
+
+	if b := newHashRing(nil).get(1); b != nil {
+		t.Fatalf("expected no shard, got %v", b)
+	}
+}
+
+func TestShardedDispatcher(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen = make(map[int64]string)
+		wg   sync.WaitGroup
+	)
+
+	worker := func(name string) *Dispatcher {
+		return NewDispatcher("token", func(chatID int64) Bot {
+			return botFunc(func(_ *Update) {
+				defer wg.Done()
+				mu.Lock()
+				defer mu.Unlock()
+				if w, ok := seen[chatID]; ok && w != name {
+					t.Errorf("chat %d delivered to %s and %s", chatID, w, name)
+				}
+				seen[chatID] = name
+			})
+		})
+	}
+
+	local := worker("local")
+	remote := worker("remote")
+	remote.SetSecretToken("secret")
+	srv := httptest.NewServer(http.HandlerFunc(remote.HandleWebhook))
+	defer srv.Close()
+
+	front := NewShardedDispatcher("token", map[string]Transport{
+		"local":  NewLocalTransport(local),
+		"remote": NewHTTPTransport(srv.URL, "secret"),
+	})
+	front.SetErrorHandler(func(err error) { t.Error(err) })
+
+	id := 1
+	for round := 0; round < 3; round++ {
+		for chat := int64(1); chat <= 20; chat++ {
+			wg.Add(1)
+			front.push(context.Background(), &Update{ID: id, Message: &Message{Chat: Chat{ID: chat}}}, false)
+			id++
+		}
+	}
+	wg.Wait()
+
+	workers := make(map[string]bool)
+	for _, w := range seen {
+		workers[w] = true
+	}
+	if len(seen) != 20 || len(workers) != 2 {
+		t.Fatalf("unexpected distribution %v", seen)
+	}
+}
+
+func TestShardedDispatcherSessions(t *testing.T) {
+	front := NewShardedDispatcher("token", map[string]Transport{"none": nopTransport{}})
+	front.AddSession(1)
+
+	if n := front.SessionCount(); n != 0 {
+		t.Fatalf("expected no sessions on the front-end, got %d", n)
+	}
+	if bot, err := front.instance(1); bot != nil || err != nil {
+		t.Fatalf("expected no Bot, got %v (%v)", bot, err)
+	}
+}
@@ -19,12 +19,12 @@
 package echotron
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"time"
 )
 
 // PollingUpdates is a wrapper function for PollingUpdatesOptions.
@@ -33,53 +33,124 @@ func PollingUpdates(token string) <-chan *Update {
 }
 
 // PollingUpdatesOptions returns a read-only channel of incoming  updates from the Telegram API.
+// If opts.OffsetStore is set, an update is saved in it as processed as soon as
+// the next one is received from the channel, and polling resumes from the
+// saved offset without dropping the pending updates.
+// The channel is closed, and the error logged, if polling fails with an error
+// that can't be solved by retrying, such as an invalid token.
 func PollingUpdatesOptions(token string, dropPendingUpdates bool, opts UpdateOptions) <-chan *Update {
-	var updates = make(chan *Update)
+	updates, errc := PollingUpdatesContext(context.Background(), token, dropPendingUpdates, opts)
+	go logError("echotron.PollingUpdates", errc)
+	return updates
+}
+
+// PollingUpdatesContext is like PollingUpdatesOptions but it stops polling when
+// ctx is done.
+// Transient errors are retried with an exponential backoff, while the error
+// that makes polling stop, be it the one of ctx or one that can't be solved by
+// retrying, is sent on the returned error channel.
+// Both channels are closed once polling has stopped.
+func PollingUpdatesContext(ctx context.Context, token string, dropPendingUpdates bool, opts UpdateOptions) (<-chan *Update, <-chan error) {
+	var (
+		updates = make(chan *Update)
+		errc    = make(chan error, 1)
+	)
 
 	go func() {
+		defer close(errc)
 		defer close(updates)
 
-		var (
-			api        = NewAPI(token)
-			timeout    = opts.Timeout
-			isFirstRun = true
-		)
+		if err := pollUpdates(ctx, NewAPI(token), dropPendingUpdates, opts, updates); err != nil {
+			errc <- err
+		}
+	}()
 
-		// deletes webhook if present to run in long polling mode
-		if _, err := api.DeleteWebhook(dropPendingUpdates); err != nil {
-			log.Println("echotron.PollingUpdates", err)
+	return updates, errc
+}
+
+// pollUpdates sends the updates received by long polling on updates until ctx
+// is done or an error that can't be solved by retrying occurs.
+func pollUpdates(ctx context.Context, api API, dropPendingUpdates bool, opts UpdateOptions, updates chan<- *Update) error {
+	var (
+		bo         backoff
+		delivered  int
+		store      = opts.OffsetStore
+		timeout    = opts.Timeout
+		isFirstRun = true
+	)
+
+	if store != nil {
+		offset, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			opts.Offset = offset + 1
+			dropPendingUpdates = false
 		}
+	}
 
-		for {
-			if isFirstRun {
-				opts.Timeout = 0
-			}
+	// deletes webhook if present to run in long polling mode
+	for {
+		_, err := api.DeleteWebhook(dropPendingUpdates)
+		if err == nil {
+			break
+		}
+		log.Println("echotron.PollingUpdates", err)
+		if err := bo.retry(ctx, err); err != nil {
+			return err
+		}
+	}
+	bo.reset()
 
-			response, err := api.GetUpdates(&opts)
-			if err != nil {
-				log.Println("echotron.PollingUpdates", err)
-				time.Sleep(5 * time.Second)
-				continue
+	for {
+		if isFirstRun {
+			opts.Timeout = 0
+		}
+
+		response, err := api.getUpdates(ctx, &opts)
+		if err != nil {
+			log.Println("echotron.PollingUpdates", err)
+			if err := bo.retry(ctx, err); err != nil {
+				return err
 			}
+			continue
+		}
+		bo.reset()
 
-			if !dropPendingUpdates || !isFirstRun {
-				for _, u := range response.Result {
-					updates <- u
+		l := len(response.Result)
+		if !dropPendingUpdates || !isFirstRun {
+			for _, u := range response.Result {
+				select {
+				case updates <- u:
+				case <-ctx.Done():
+					return ctx.Err()
 				}
-			}
 
-			if l := len(response.Result); l > 0 {
-				opts.Offset = response.Result[l-1].ID + 1
+				// Receiving an update means the consumer is done with the
+				// previous one, so that one can be saved as processed.
+				if store != nil && delivered > 0 {
+					if err := store.Save(delivered); err != nil {
+						log.Println("echotron.PollingUpdates", err)
+					}
+				}
+				delivered = u.ID
 			}
-
-			if isFirstRun {
-				isFirstRun = false
-				opts.Timeout = timeout
+		} else if store != nil && l > 0 {
+			if err := store.Save(response.Result[l-1].ID); err != nil {
+				log.Println("echotron.PollingUpdates", err)
 			}
 		}
-	}()
 
-	return updates
+		if l > 0 {
+			opts.Offset = response.Result[l-1].ID + 1
+		}
+
+		if isFirstRun {
+			isFirstRun = false
+			opts.Timeout = timeout
+		}
+	}
 }
 
 // WebhookUpdates is a wrapper function for WebhookUpdatesOptions.
@@ -92,46 +163,104 @@ func WebhookUpdates(url, token string) <-chan *Update {
 // eg: 'https://example.com:443/bot_token'.
 // WebhookUpdatesOptions will then proceed to communicate the webhook url '<hostname>/<path>'
 // to Telegram and run a webserver that listens to ':<port>' and handles the path.
+// If the webhook can't be set or the webserver stops, the error is logged and
+// the channel is closed.
 func WebhookUpdatesOptions(whURL, token string, dropPendingUpdates bool, opts *WebhookOptions) <-chan *Update {
+	updates, errc, err := WebhookUpdatesContext(context.Background(), whURL, token, dropPendingUpdates, opts)
+	if err != nil {
+		log.Println("echotron.WebhookUpdates", err)
+		closed := make(chan *Update)
+		close(closed)
+		return closed
+	}
+
+	go logError("echotron.WebhookUpdates", errc)
+	return updates
+}
+
+// WebhookUpdatesContext is like WebhookUpdatesOptions but it returns the error
+// occurred setting the webhook, and it stops the webserver when ctx is done.
+// The webserver uses its own http.ServeMux, so it doesn't interfere with the
+// handlers registered on http.DefaultServeMux.
+// The error that makes the webserver stop, be it the one of ctx or the one
+// returned by http.Server.ListenAndServe, is sent on the returned error channel.
+// Both channels are closed once the webserver has stopped.
+func WebhookUpdatesContext(ctx context.Context, whURL, token string, dropPendingUpdates bool, opts *WebhookOptions) (<-chan *Update, <-chan error, error) {
+	return webhookUpdates(ctx, NewAPI(token), whURL, dropPendingUpdates, opts)
+}
+
+// webhookUpdates sets the webhook with api and serves it.
+func webhookUpdates(ctx context.Context, api API, whURL string, dropPendingUpdates bool, opts *WebhookOptions) (<-chan *Update, <-chan error, error) {
 	u, err := url.Parse(whURL)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 
 	wURL := u.Hostname() + u.EscapedPath()
-	api := NewAPI(token)
 	if _, err := api.SetWebhook(wURL, dropPendingUpdates, opts); err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 
-	var updates = make(chan *Update)
-	http.HandleFunc(u.EscapedPath(), func(w http.ResponseWriter, r *http.Request) {
-		var update Update
+	var secretToken string
+	if opts != nil {
+		secretToken = opts.SecretToken
+	}
 
-		jsn, err := readRequest(r)
+	var (
+		updates = make(chan *Update)
+		errc    = make(chan error, 1)
+		mux     = http.NewServeMux()
+		srv     = &http.Server{Addr: fmt.Sprintf(":%s", u.Port()), Handler: mux}
+	)
+	ctx, cancel := context.WithCancel(ctx)
+
+	mux.HandleFunc(u.EscapedPath(), func(w http.ResponseWriter, r *http.Request) {
+		update, code, err := readUpdate(w, r, secretToken)
 		if err != nil {
 			log.Println("echotron.WebhookUpdates", err)
+			http.Error(w, http.StatusText(code), code)
 			return
 		}
 
-		if err := json.Unmarshal(jsn, &update); err != nil {
-			log.Println("echotron.WebhookUpdates", err)
-			return
+		select {
+		case updates <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-ctx.Done():
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		case <-r.Context().Done():
 		}
-
-		updates <- &update
 	})
 
 	go func() {
+		defer close(errc)
 		defer close(updates)
-		port := fmt.Sprintf(":%s", u.Port())
-		for {
-			if err := http.ListenAndServe(port, nil); err != nil {
-				log.Println("echotron.WebhookUpdates", err)
-				time.Sleep(5 * time.Second)
-			}
+
+		served := make(chan error, 1)
+		go func() {
+			served <- srv.ListenAndServe()
+		}()
+
+		select {
+		case err = <-served:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
+
+		// Shutdown waits for the handlers, which return as soon as ctx is done,
+		// so that no update is sent on the closed channel.
+		cancel()
+		if serr := srv.Shutdown(context.Background()); serr != nil && !errors.Is(serr, http.ErrServerClosed) {
+			log.Println("echotron.WebhookUpdates", serr)
+		}
+		errc <- err
 	}()
 
-	return updates
+	return updates, errc, nil
+}
+
+// logError logs the error received from errc, if any.
+func logError(where string, errc <-chan error) {
+	if err := <-errc; err != nil {
+		log.Println(where, err)
+	}
 }
@@ -1,7 +1,126 @@
 package echotron
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestPollingUpdates(t *testing.T) {
 	PollingUpdates(api.token)
 }
+
+func TestPollUpdatesContext(t *testing.T) {
+	var calls int32
+
+	fastRetries(t)
+	api := fakeAPI(t, func(method string, _ *http.Request) string {
+		if method != "getUpdates" {
+			return `{"ok":true}`
+		}
+
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return `{"ok":true,"result":[{"update_id":1}]}`
+		case 2:
+			return `{"ok":false,"error_code":502,"description":"Bad Gateway"}`
+		case 3:
+			return `{"ok":true,"result":[{"update_id":2}]}`
+		default:
+			return `{"ok":false,"error_code":401,"description":"Unauthorized"}`
+		}
+	})
+
+	updates := make(chan *Update)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pollUpdates(context.Background(), api, false, UpdateOptions{}, updates)
+	}()
+
+	for _, id := range []int{1, 2} {
+		if u := <-updates; u.ID != id {
+			t.Fatalf("expected update %d, got %d", id, u.ID)
+		}
+	}
+
+	var apiErr *APIError
+	if err := <-errc; !errors.As(err, &apiErr) || apiErr.ErrorCode() != 401 {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+}
+
+func TestPollUpdatesCancel(t *testing.T) {
+	api := fakeAPI(t, func(_ string, _ *http.Request) string {
+		return `{"ok":true,"result":[{"update_id":1}]}`
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		// Nobody receives the updates, so only ctx can stop it.
+		errc <- pollUpdates(ctx, api, false, UpdateOptions{}, make(chan *Update))
+	}()
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+}
+
+func TestWebhookUpdatesContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	api := fakeAPI(t, func(_ string, _ *http.Request) string { return `{"ok":true}` })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	whURL := fmt.Sprintf("https://example.com:%d/hook", port)
+	updates, errc, err := webhookUpdates(ctx, api, whURL, false, &WebhookOptions{SecretToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := webhookUpdates(ctx, api, "://bad", false, nil); err == nil {
+		t.Fatal("expected an error for an invalid URL")
+	}
+
+	post := func() (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/hook", port), strings.NewReader(`{"update_id":7}`))
+		req.Header.Set(secretTokenHeader, "secret")
+		return http.DefaultClient.Do(req)
+	}
+
+	go func() {
+		// Retry until the server is listening.
+		for i := 0; i < 100; i++ {
+			if res, err := post(); err == nil {
+				res.Body.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if u := <-updates; u.ID != 7 {
+		t.Fatalf("expected update 7, got %d", u.ID)
+	}
+
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+	if _, ok := <-updates; ok {
+		t.Fatal("updates channel not closed")
+	}
+}
@@ -21,6 +21,20 @@ func (s *smap[K, V]) loadOrStore(key K, val V) (actual V, loaded bool) {
 	return a.(V), loaded
 }
 
+func (s *smap[K, V]) loadAndDelete(key K) (val V, loaded bool) {
+	v, loaded := (*sync.Map)(s).LoadAndDelete(key)
+	if !loaded {
+		return
+	}
+	return v.(V), loaded
+}
+
 func (s *smap[K, V]) delete(key K) {
 	(*sync.Map)(s).Delete(key)
 }
+
+func (s *smap[K, V]) rangeAll(fn func(key K, val V) bool) {
+	(*sync.Map)(s).Range(func(k, v any) bool {
+		return fn(k.(K), v.(V))
+	})
+}
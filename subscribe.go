@@ -0,0 +1,191 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+// UpdateSubscriber is implemented by the bots and the handlers that know which
+// update types they handle.
+// The Dispatcher uses it to compute the list of allowed updates to request to
+// Telegram when the options passed to it don't specify one.
+type UpdateSubscriber interface {
+	AllowedUpdates() []UpdateType
+}
+
+// UpdateTypes is a list of update types that implements UpdateSubscriber.
+type UpdateTypes []UpdateType
+
+// AllowedUpdates returns the list itself.
+func (u UpdateTypes) AllowedUpdates() []UpdateType {
+	return u
+}
+
+// AllUpdateTypes returns all the update types a bot can be subscribed to,
+// including the ones Telegram doesn't send unless explicitly requested, such as
+// chat_member, message_reaction and message_reaction_count.
+func AllUpdateTypes() []UpdateType {
+	return []UpdateType{
+		MessageUpdate,
+		EditedMessageUpdate,
+		ChannelPostUpdate,
+		EditedChannelPostUpdate,
+		BusinessConnectionUpdate,
+		BusinessMessageUpdate,
+		EditedBusinessMessageUpdate,
+		DeletedBusinessMessagesUpdate,
+		MessageReactionUpdate,
+		MessageReactionCountUpdate,
+		InlineQueryUpdate,
+		ChosenInlineResultUpdate,
+		CallbackQueryUpdate,
+		ShippingQueryUpdate,
+		PreCheckoutQueryUpdate,
+		PurchasedPaidMediaUpdate,
+		PollUpdate,
+		PollAnswerUpdate,
+		MyChatMemberUpdate,
+		ChatMemberUpdate,
+		ChatJoinRequestUpdate,
+		ChatBoostUpdate,
+		RemovedChatBoostUpdate,
+	}
+}
+
+// Type returns the type of the update, or an empty string if it's unknown.
+func (u Update) Type() UpdateType {
+	switch {
+	case u.Message != nil:
+		return MessageUpdate
+	case u.EditedMessage != nil:
+		return EditedMessageUpdate
+	case u.ChannelPost != nil:
+		return ChannelPostUpdate
+	case u.EditedChannelPost != nil:
+		return EditedChannelPostUpdate
+	case u.BusinessConnection != nil:
+		return BusinessConnectionUpdate
+	case u.BusinessMessage != nil:
+		return BusinessMessageUpdate
+	case u.EditedBusinessMessage != nil:
+		return EditedBusinessMessageUpdate
+	case u.DeletedBusinessMessages != nil:
+		return DeletedBusinessMessagesUpdate
+	case u.MessageReaction != nil:
+		return MessageReactionUpdate
+	case u.MessageReactionCount != nil:
+		return MessageReactionCountUpdate
+	case u.InlineQuery != nil:
+		return InlineQueryUpdate
+	case u.ChosenInlineResult != nil:
+		return ChosenInlineResultUpdate
+	case u.CallbackQuery != nil:
+		return CallbackQueryUpdate
+	case u.ShippingQuery != nil:
+		return ShippingQueryUpdate
+	case u.PreCheckoutQuery != nil:
+		return PreCheckoutQueryUpdate
+	case u.PurchasedPaidMedia != nil:
+		return PurchasedPaidMediaUpdate
+	case u.Poll != nil:
+		return PollUpdate
+	case u.PollAnswer != nil:
+		return PollAnswerUpdate
+	case u.MyChatMember != nil:
+		return MyChatMemberUpdate
+	case u.ChatMember != nil:
+		return ChatMemberUpdate
+	case u.ChatJoinRequest != nil:
+		return ChatJoinRequestUpdate
+	case u.ChatBoost != nil:
+		return ChatBoostUpdate
+	case u.RemovedChatBoost != nil:
+		return RemovedChatBoostUpdate
+	default:
+		return ""
+	}
+}
+
+// Subscribe registers handlers that contribute to the list of allowed updates
+// returned by AllowedUpdates.
+// Since the bots returned by NewBotFn are created only when the first update of
+// their chat arrives, the update types they handle must be registered here,
+// for instance with UpdateTypes.
+// It must be called before the Dispatcher starts receiving updates.
+func (d *Dispatcher) Subscribe(s ...UpdateSubscriber) {
+	d.subscribers = append(d.subscribers, s...)
+}
+
+// AllowedUpdates returns the union of the update types handled by the
+// subscribers registered with Subscribe, the global Bot and the live sessions
+// implementing UpdateSubscriber, in the order of AllUpdateTypes.
+// It returns nil if none of them specifies any, in which case Telegram sends
+// all the update types except chat_member, message_reaction and
+// message_reaction_count.
+// PollContext, ListenWebhookOptions and ListenWebhookTLS use it when the
+// options passed to them don't list the allowed updates.
+func (d *Dispatcher) AllowedUpdates() []UpdateType {
+	var (
+		ret  []UpdateType
+		want = make(map[UpdateType]bool)
+	)
+
+	add := func(b any) {
+		if s, ok := b.(UpdateSubscriber); ok {
+			for _, t := range s.AllowedUpdates() {
+				want[t] = true
+			}
+		}
+	}
+
+	for _, s := range d.subscribers {
+		add(s)
+	}
+	if d.global != nil {
+		add(unwrapBot(d.global))
+	}
+	d.sessions.rangeAll(func(_ int64, b Bot) bool {
+		add(unwrapBot(b))
+		return true
+	})
+
+	for _, t := range AllUpdateTypes() {
+		if want[t] {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// webhookOptions returns opts with the allowed updates of the Dispatcher, if
+// opts doesn't already list them.
+func (d *Dispatcher) webhookOptions(opts *WebhookOptions) *WebhookOptions {
+	if opts != nil && len(opts.AllowedUpdates) > 0 {
+		return opts
+	}
+
+	allowed := d.AllowedUpdates()
+	if allowed == nil {
+		return opts
+	}
+
+	var ret WebhookOptions
+	if opts != nil {
+		ret = *opts
+	}
+	ret.AllowedUpdates = allowed
+	return &ret
+}
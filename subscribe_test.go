@@ -0,0 +1,79 @@
+package echotron
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type reactionBot struct{}
+
+func (r reactionBot) Update(_ *Update) {}
+
+func (r reactionBot) AllowedUpdates() []UpdateType {
+	return []UpdateType{MessageReactionUpdate, MessageUpdate}
+}
+
+func TestUpdateType(t *testing.T) {
+	if typ := (Update{MessageReaction: &MessageReactionUpdated{}}).Type(); typ != MessageReactionUpdate {
+		t.Fatalf("expected %s, got %s", MessageReactionUpdate, typ)
+	}
+
+	if typ := (Update{}).Type(); typ != "" {
+		t.Fatalf("expected empty type, got %s", typ)
+	}
+}
+
+func TestAllowedUpdates(t *testing.T) {
+	var allowed []string
+
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	if a := d.AllowedUpdates(); a != nil {
+		t.Fatalf("expected no allowed updates, got %v", a)
+	}
+
+	d.Subscribe(UpdateTypes{CallbackQueryUpdate, MessageUpdate})
+	d.SetGlobalBot(reactionBot{})
+
+	expected := []UpdateType{MessageUpdate, MessageReactionUpdate, CallbackQueryUpdate}
+	if a := d.AllowedUpdates(); !reflect.DeepEqual(a, expected) {
+		t.Fatalf("expected %v, got %v", expected, a)
+	}
+
+	d.api = fakeAPI(t, func(method string, r *http.Request) string {
+		if method != "getUpdates" {
+			return `{"ok":true}`
+		}
+		allowed = append(allowed, r.URL.Query().Get("allowed_updates"))
+		return `{"ok":false,"error_code":401,"description":"Unauthorized"}`
+	})
+
+	var apiErr *APIError
+	if err := d.PollOptions(false, UpdateOptions{}); !errors.As(err, &apiErr) {
+		t.Fatalf("expected API error, got %v", err)
+	}
+	if err := d.PollOptions(false, UpdateOptions{AllowedUpdates: []UpdateType{PollUpdate}}); !errors.As(err, &apiErr) {
+		t.Fatalf("expected API error, got %v", err)
+	}
+
+	if e := []string{`["message","message_reaction","callback_query"]`, `["poll"]`}; !reflect.DeepEqual(allowed, e) {
+		t.Fatalf("expected allowed updates %v, got %v", e, allowed)
+	}
+}
+
+func TestWebhookOptions(t *testing.T) {
+	d := NewDispatcher("token", func(_ int64) Bot { return test{} })
+	if opts := d.webhookOptions(nil); opts != nil {
+		t.Fatalf("expected nil options, got %+v", opts)
+	}
+
+	d.Subscribe(UpdateTypes{ChatBoostUpdate})
+	opts := &WebhookOptions{SecretToken: "secret"}
+	if o := d.webhookOptions(opts); o.SecretToken != "secret" || !reflect.DeepEqual(o.AllowedUpdates, []UpdateType{ChatBoostUpdate}) {
+		t.Fatalf("unexpected options %+v", o)
+	}
+	if opts.AllowedUpdates != nil {
+		t.Fatal("options passed by the caller modified")
+	}
+}
@@ -50,53 +50,109 @@ type Update struct {
 	ID                      int                          `json:"update_id"`
 }
 
-// ChatID returns the ID of the chat the update is coming from.
-func (u Update) ChatID() int64 {
+// ChatID returns the ID of the chat the update is coming from and true.
+// For the updates sent by a user outside of any chat, such as inline queries
+// and callback queries from inline messages, it returns the ID of the user,
+// which is also the ID of the private chat with them.
+// If the update isn't associated with any chat nor user, as it happens for
+// polls and unknown update types, it returns 0 and false.
+func (u Update) ChatID() (int64, bool) {
 	switch {
 	case u.ChatJoinRequest != nil:
-		return u.ChatJoinRequest.Chat.ID
+		return u.ChatJoinRequest.Chat.ID, true
 	case u.ChatBoost != nil:
-		return u.ChatBoost.Chat.ID
+		return u.ChatBoost.Chat.ID, true
 	case u.RemovedChatBoost != nil:
-		return u.RemovedChatBoost.Chat.ID
+		return u.RemovedChatBoost.Chat.ID, true
 	case u.Message != nil:
-		return u.Message.Chat.ID
+		return u.Message.Chat.ID, true
 	case u.EditedMessage != nil:
-		return u.EditedMessage.Chat.ID
+		return u.EditedMessage.Chat.ID, true
 	case u.ChannelPost != nil:
-		return u.ChannelPost.Chat.ID
+		return u.ChannelPost.Chat.ID, true
 	case u.EditedChannelPost != nil:
-		return u.EditedChannelPost.Chat.ID
+		return u.EditedChannelPost.Chat.ID, true
 	case u.BusinessConnection != nil:
-		return u.BusinessConnection.User.ID
+		return u.BusinessConnection.User.ID, true
 	case u.BusinessMessage != nil:
-		return u.BusinessMessage.Chat.ID
+		return u.BusinessMessage.Chat.ID, true
 	case u.EditedBusinessMessage != nil:
-		return u.EditedBusinessMessage.Chat.ID
+		return u.EditedBusinessMessage.Chat.ID, true
 	case u.DeletedBusinessMessages != nil:
-		return u.DeletedBusinessMessages.Chat.ID
+		return u.DeletedBusinessMessages.Chat.ID, true
 	case u.MessageReaction != nil:
-		return u.MessageReaction.Chat.ID
+		return u.MessageReaction.Chat.ID, true
 	case u.MessageReactionCount != nil:
-		return u.MessageReactionCount.Chat.ID
+		return u.MessageReactionCount.Chat.ID, true
+	case u.InlineQuery != nil && u.InlineQuery.From != nil:
+		return u.InlineQuery.From.ID, true
+	case u.ChosenInlineResult != nil && u.ChosenInlineResult.From != nil:
+		return u.ChosenInlineResult.From.ID, true
+	case u.CallbackQuery != nil && u.CallbackQuery.Message != nil:
+		return u.CallbackQuery.Message.Chat.ID, true
+	case u.CallbackQuery != nil && u.CallbackQuery.From != nil:
+		return u.CallbackQuery.From.ID, true
+	case u.ShippingQuery != nil:
+		return u.ShippingQuery.From.ID, true
+	case u.PreCheckoutQuery != nil:
+		return u.PreCheckoutQuery.From.ID, true
+	case u.PollAnswer != nil && u.PollAnswer.User != nil:
+		return u.PollAnswer.User.ID, true
+	case u.PollAnswer != nil && u.PollAnswer.VoterChat != nil:
+		return u.PollAnswer.VoterChat.ID, true
+	case u.MyChatMember != nil:
+		return u.MyChatMember.Chat.ID, true
+	case u.ChatMember != nil:
+		return u.ChatMember.Chat.ID, true
+	case u.PurchasedPaidMedia != nil:
+		return u.PurchasedPaidMedia.From.ID, true
+	default:
+		return 0, false
+	}
+}
+
+// Sender returns the user who caused the update, or nil if it isn't known, as
+// it happens for channel posts, messages sent on behalf of a chat and polls.
+func (u Update) Sender() *User {
+	switch {
+	case u.Message != nil:
+		return u.Message.From
+	case u.EditedMessage != nil:
+		return u.EditedMessage.From
+	case u.ChannelPost != nil:
+		return u.ChannelPost.From
+	case u.EditedChannelPost != nil:
+		return u.EditedChannelPost.From
+	case u.BusinessMessage != nil:
+		return u.BusinessMessage.From
+	case u.EditedBusinessMessage != nil:
+		return u.EditedBusinessMessage.From
+	case u.BusinessConnection != nil:
+		return &u.BusinessConnection.User
+	case u.MessageReaction != nil && u.MessageReaction.User.ID != 0:
+		return &u.MessageReaction.User
+	case u.CallbackQuery != nil:
+		return u.CallbackQuery.From
 	case u.InlineQuery != nil:
-		return u.InlineQuery.From.ID
+		return u.InlineQuery.From
 	case u.ChosenInlineResult != nil:
-		return u.ChosenInlineResult.From.ID
-	case u.CallbackQuery != nil:
-		return u.CallbackQuery.Message.Chat.ID
+		return u.ChosenInlineResult.From
 	case u.ShippingQuery != nil:
-		return u.ShippingQuery.From.ID
+		return &u.ShippingQuery.From
 	case u.PreCheckoutQuery != nil:
-		return u.PreCheckoutQuery.From.ID
+		return &u.PreCheckoutQuery.From
+	case u.PurchasedPaidMedia != nil:
+		return &u.PurchasedPaidMedia.From
 	case u.PollAnswer != nil:
-		return u.PollAnswer.User.ID
+		return u.PollAnswer.User
 	case u.MyChatMember != nil:
-		return u.MyChatMember.Chat.ID
+		return &u.MyChatMember.From
 	case u.ChatMember != nil:
-		return u.ChatMember.Chat.ID
+		return &u.ChatMember.From
+	case u.ChatJoinRequest != nil:
+		return &u.ChatJoinRequest.From
 	default:
-		return 0
+		return nil
 	}
 }
 
@@ -122,9 +178,10 @@ type APIResponse interface {
 // APIResponseBase is a base type that represents the incoming response from Telegram servers.
 // Used by APIResponse* to slim down the implementation.
 type APIResponseBase struct {
-	Description string `json:"description,omitempty"`
-	ErrorCode   int    `json:"error_code,omitempty"`
-	Ok          bool   `json:"ok"`
+	Parameters  *ResponseParameters `json:"parameters,omitempty"`
+	Description string              `json:"description,omitempty"`
+	ErrorCode   int                 `json:"error_code,omitempty"`
+	Ok          bool                `json:"ok"`
 }
 
 // Base returns the APIResponseBase itself.
@@ -294,3 +294,41 @@ func TestInputProfilePhotoAnimated(_ *testing.T) {
 	i := InputProfilePhotoAnimated{}
 	i.ImplementsInputProfilePhoto()
 }
+
+func TestUpdateChatID(t *testing.T) {
+	tests := []struct {
+		name   string
+		update Update
+		id     int64
+		ok     bool
+	}{
+		{"message", Update{Message: &Message{Chat: Chat{ID: 1}}}, 1, true},
+		{"callback", Update{CallbackQuery: &CallbackQuery{Message: &Message{Chat: Chat{ID: 2}}}}, 2, true},
+		{"inline callback", Update{CallbackQuery: &CallbackQuery{From: &User{ID: 3}}}, 3, true},
+		{"inline query", Update{InlineQuery: &InlineQuery{From: &User{ID: 4}}}, 4, true},
+		{"inline query without sender", Update{InlineQuery: &InlineQuery{}}, 0, false},
+		{"poll", Update{Poll: &Poll{}}, 0, false},
+		{"empty", Update{}, 0, false},
+	}
+
+	for _, tt := range tests {
+		id, ok := tt.update.ChatID()
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("%s: expected (%d, %t), got (%d, %t)", tt.name, tt.id, tt.ok, id, ok)
+		}
+	}
+}
+
+func TestUpdateSender(t *testing.T) {
+	if u := (Update{ShippingQuery: &ShippingQuery{From: User{ID: 1}}}).Sender(); u == nil || u.ID != 1 {
+		t.Fatalf("unexpected sender %+v", u)
+	}
+
+	if u := (Update{MessageReaction: &MessageReactionUpdated{}}).Sender(); u != nil {
+		t.Fatalf("expected no sender for anonymous reaction, got %+v", u)
+	}
+
+	if u := (Update{Poll: &Poll{}}).Sender(); u != nil {
+		t.Fatalf("expected no sender for poll, got %+v", u)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// UpdateError is the error reported to the error handler of the Dispatcher
+// when the processing of an update fails, either because the Bot panicked or
+// because a FallibleBot returned an error.
+type UpdateError struct {
+	// Err is the error returned by the Bot or the value it panicked with.
+	Err error
+	// Update is the update being processed, nil if the error was raised while
+	// delivering an event.
+	Update *Update
+	// Stack is the stack trace of the goroutine that panicked, nil if the Bot
+	// didn't panic.
+	Stack []byte
+	// ChatID is the key of the session the update was delivered to.
+	ChatID int64
+}
+
+// Error returns the error string.
+func (e *UpdateError) Error() string {
+	if e.Update == nil {
+		return fmt.Sprintf("echotron: chat %d: %v", e.ChatID, e.Err)
+	}
+	return fmt.Sprintf("echotron: update %d in chat %d: %v", e.Update.ID, e.ChatID, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
+
+// FallibleBot is like Bot but its Update method returns an error, which is
+// reported to the error handler of the Dispatcher.
+// Use Fallible to return a FallibleBot from a NewBotFn.
+type FallibleBot interface {
+	Update(*Update) error
+}
+
+// Fallible wraps b so that it can be used as a Bot.
+// The optional interfaces implemented by b, such as Starter and Stopper, are
+// still honoured by the Dispatcher.
+func Fallible(b FallibleBot) Bot {
+	return fallible{b}
+}
+
+type fallible struct {
+	FallibleBot
+}
+
+// Update calls the Update method of the wrapped FallibleBot discarding its error,
+// the Dispatcher calls the wrapped method directly to collect it.
+func (f fallible) Update(u *Update) {
+	f.FallibleBot.Update(u)
+}
+
+// unwrapBot returns the value implementing the optional interfaces of b.
+func unwrapBot(b Bot) any {
+	if f, ok := b.(fallible); ok {
+		return f.FallibleBot
+	}
+	return b
+}
+
+// callBot calls the Update or UpdateContext method of b and returns its error,
+// if any.
+func callBot(ctx context.Context, b Bot, u *Update) error {
+	switch b := b.(type) {
+	case fallible:
+		return b.FallibleBot.Update(u)
+	case ContextBot:
+		b.UpdateContext(ctx, u)
+	default:
+		b.Update(u)
+	}
+	return nil
+}
+
+// SetErrorHandler sets the function called with the errors occurred while
+// processing the updates, which are of type *UpdateError.
+// The panics of the Bots are recovered and reported to it as well, so that
+// a panic in a single session doesn't crash the whole process.
+// By default the errors are logged with the standard logger.
+func (d *Dispatcher) SetErrorHandler(fn func(error)) {
+	d.errHandler = fn
+}
+
+// handleError reports err to the error handler.
+func (d *Dispatcher) handleError(err error) {
+	if d.errHandler != nil {
+		d.errHandler(err)
+		return
+	}
+
+	var uerr *UpdateError
+	if errors.As(err, &uerr) && uerr.Stack != nil {
+		log.Printf("echotron.Dispatcher %v\n%s", err, uerr.Stack)
+		return
+	}
+	log.Println("echotron.Dispatcher", err)
+}
+
+// safely runs fn, which processes update, reporting the error it returns or
+// the panic it raises to the error handler.
+func (d *Dispatcher) safely(update *Update, fn func() error) {
+	chatID, _ := update.ChatID()
+	d.guard(chatID, update, fn)
+}
+
+// guard runs fn on behalf of the session of chatID, reporting the error it
+// returns or the panic it raises to the error handler.
+// The update is nil when fn doesn't process one.
+func (d *Dispatcher) guard(chatID int64, update *Update, fn func() error) {
+	if err := protect(chatID, update, fn); err != nil {
+		d.handleError(err)
+	}
+}
+
+// protect runs fn on behalf of the session of chatID and returns the error it
+// returns or the panic it raises as an *UpdateError.
+func protect(chatID int64, update *Update, fn func() error) (uerr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("panic: %v", r)
+			if e, ok := r.(error); ok {
+				err = fmt.Errorf("panic: %w", e)
+			}
+			uerr = &UpdateError{
+				Err:    err,
+				Update: update,
+				Stack:  debug.Stack(),
+				ChatID: chatID,
+			}
+		}
+	}()
+
+	if err := fn(); err != nil {
+		return &UpdateError{
+			Err:    err,
+			Update: update,
+			ChatID: chatID,
+		}
+	}
+	return nil
+}
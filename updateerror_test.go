@@ -0,0 +1,55 @@
+package echotron
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type failingBot struct {
+	started *bool
+}
+
+func (f failingBot) Update(_ *Update) error { return errors.New("failure") }
+func (f failingBot) Start()                 { *f.started = true }
+
+func TestPanicRecovery(t *testing.T) {
+	errc := make(chan error, 1)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return botFunc(func(_ *Update) { panic("boom") })
+	})
+	d.SetErrorHandler(func(err error) { errc <- err })
+	d.push(context.Background(), &Update{ID: 3, Message: &Message{Chat: Chat{ID: 5}}}, false)
+
+	var uerr *UpdateError
+	if err := <-errc; !errors.As(err, &uerr) {
+		t.Fatalf("expected *UpdateError, got %v", err)
+	}
+
+	if uerr.ChatID != 5 || uerr.Update.ID != 3 || len(uerr.Stack) == 0 {
+		t.Fatalf("unexpected error %+v", uerr)
+	}
+}
+
+func TestFallible(t *testing.T) {
+	var (
+		started bool
+		errc    = make(chan error, 1)
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot {
+		return Fallible(failingBot{&started})
+	})
+	d.SetErrorHandler(func(err error) { errc <- err })
+	d.push(context.Background(), &Update{ID: 1, Message: &Message{Chat: Chat{ID: 2}}}, false)
+
+	var uerr *UpdateError
+	if err := <-errc; !errors.As(err, &uerr) || uerr.Err.Error() != "failure" || uerr.Stack != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !started {
+		t.Fatal("Start not called on the wrapped bot")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"context"
+	"time"
+)
+
+// WebhookEventType is the kind of a WebhookEvent.
+type WebhookEventType int
+
+// These are the events raised by WebhookMonitor.
+const (
+	// WebhookCheckFailed means GetWebhookInfo returned an error.
+	WebhookCheckFailed WebhookEventType = iota
+	// WebhookDeliveryError means Telegram reported a new error delivering the
+	// updates to the webhook.
+	WebhookDeliveryError
+	// WebhookRecovered means no new delivery error has been reported since the
+	// last check that raised a WebhookDeliveryError.
+	WebhookRecovered
+	// WebhookBacklog means the number of pending updates grew and reached
+	// the backlog threshold.
+	WebhookBacklog
+	// WebhookURLMismatch means the webhook registered on Telegram isn't the
+	// expected one, as it happens when it's deleted or replaced by another
+	// instance of the bot.
+	WebhookURLMismatch
+)
+
+// WebhookEvent is raised by WebhookMonitor when it detects a change in the
+// health of the webhook.
+type WebhookEvent struct {
+	// Info is the information returned by GetWebhookInfo, nil for
+	// WebhookCheckFailed.
+	Info *WebhookInfo
+	// Err is the error returned by GetWebhookInfo for WebhookCheckFailed.
+	Err  error
+	Type WebhookEventType
+}
+
+// defaultBacklogThreshold is the backlog threshold of WebhookMonitor if none
+// is specified.
+const defaultBacklogThreshold = 100
+
+// WebhookMonitor periodically checks the status of the webhook with
+// GetWebhookInfo and calls OnEvent when it detects new delivery errors,
+// a growing backlog or a webhook url different from the expected one.
+type WebhookMonitor struct {
+	// OnEvent is called with every event detected by the monitor.
+	OnEvent func(WebhookEvent)
+	// URL is the expected url of the webhook, as returned by GetWebhookInfo.
+	// If empty, the url isn't checked.
+	URL string
+	// API is used to call GetWebhookInfo.
+	API API
+	// Interval is the interval between two checks, one minute if 0.
+	Interval time.Duration
+	// BacklogThreshold is the number of pending updates from which a growing
+	// backlog raises WebhookBacklog, 100 if 0.
+	BacklogThreshold int
+}
+
+// Run checks the webhook until ctx is done, then returns its error.
+// Only the delivery errors occurred after Run is called raise events.
+func (m *WebhookMonitor) Run(ctx context.Context) error {
+	var (
+		lastError  int64
+		pending    int
+		failing    bool
+		mismatched bool
+		interval   = m.Interval
+		threshold  = m.BacklogThreshold
+	)
+
+	if interval == 0 {
+		interval = time.Minute
+	}
+	if threshold == 0 {
+		threshold = defaultBacklogThreshold
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if res, err := m.API.GetWebhookInfo(); err == nil && res.Result != nil {
+		lastError = res.Result.LastErrorDate
+		pending = res.Result.PendingUpdateCount
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		res, err := m.API.GetWebhookInfo()
+		if err == nil && res.Result == nil {
+			continue
+		}
+		if err != nil {
+			m.raise(WebhookEvent{Type: WebhookCheckFailed, Err: err})
+			continue
+		}
+		info := res.Result
+
+		switch {
+		case info.LastErrorDate > lastError:
+			lastError = info.LastErrorDate
+			failing = true
+			m.raise(WebhookEvent{Type: WebhookDeliveryError, Info: info})
+		case failing:
+			failing = false
+			m.raise(WebhookEvent{Type: WebhookRecovered, Info: info})
+		}
+
+		if info.PendingUpdateCount > pending && info.PendingUpdateCount >= threshold {
+			m.raise(WebhookEvent{Type: WebhookBacklog, Info: info})
+		}
+		pending = info.PendingUpdateCount
+
+		if m.URL != "" && info.URL != m.URL {
+			if !mismatched {
+				m.raise(WebhookEvent{Type: WebhookURLMismatch, Info: info})
+			}
+			mismatched = true
+		} else {
+			mismatched = false
+		}
+	}
+}
+
+// raise calls OnEvent, if set.
+func (m *WebhookMonitor) raise(e WebhookEvent) {
+	if m.OnEvent != nil {
+		m.OnEvent(e)
+	}
+}
@@ -0,0 +1,68 @@
+package echotron
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookMonitor(t *testing.T) {
+	var (
+		calls  int32
+		events = make(chan WebhookEventType, 20)
+	)
+
+	responses := []string{
+		`{"ok":true,"result":{"url":"https://example.com/hook","last_error_date":1}}`,
+		`{"ok":true,"result":{"url":"https://example.com/hook","last_error_date":2,"pending_update_count":5}}`,
+		`{"ok":true,"result":{"url":"https://example.com/hook","last_error_date":2,"pending_update_count":150}}`,
+		`{"ok":false,"error_code":500,"description":"Internal Server Error"}`,
+		`{"ok":true,"result":{"url":"","last_error_date":2}}`,
+		`{"ok":true,"result":{"url":"","last_error_date":2}}`,
+	}
+
+	api := fakeAPI(t, func(_ string, _ *http.Request) string {
+		n := int(atomic.AddInt32(&calls, 1)) - 1
+		if n >= len(responses) {
+			n = len(responses) - 1
+		}
+		return responses[n]
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := WebhookMonitor{
+		API:      api,
+		URL:      "https://example.com/hook",
+		Interval: time.Millisecond,
+		OnEvent:  func(e WebhookEvent) { events <- e.Type },
+	}
+	go m.Run(ctx)
+
+	var got []WebhookEventType
+	for len(got) < 5 {
+		got = append(got, <-events)
+	}
+
+	expected := []WebhookEventType{
+		WebhookDeliveryError,
+		WebhookRecovered,
+		WebhookBacklog,
+		WebhookCheckFailed,
+		WebhookURLMismatch,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected events %v, got %v", expected, got)
+	}
+
+	// The mismatch is reported only once.
+	time.Sleep(10 * time.Millisecond)
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %v", <-events)
+	}
+	cancel()
+}
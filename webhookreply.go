@@ -0,0 +1,96 @@
+/*
+ * Echotron
+ * Copyright (C) 2018 The Echotron Contributors
+ *
+ * Echotron is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Echotron is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package echotron
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// WebhookReplier is an optional interface for Bot.
+// When the Dispatcher replies to webhooks synchronously (see SetWebhookReply),
+// UpdateReply is called in place of Update and the returned WebhookReply,
+// if not nil, is performed by Telegram as the answer to the webhook request,
+// saving the round trip of a separate API call.
+type WebhookReplier interface {
+	UpdateReply(*Update) *WebhookReply
+}
+
+// WebhookReply represents a single call to a method of the Telegram Bot API
+// sent in the body of the response to a webhook request.
+// Telegram doesn't report the result of such calls, so only the methods whose
+// result isn't needed should be used this way.
+type WebhookReply struct {
+	vals   url.Values
+	method string
+}
+
+// NewWebhookReply returns a WebhookReply that calls the given method of the
+// Telegram Bot API, eg: "sendMessage", with the given parameters.
+func NewWebhookReply(method string, params url.Values) *WebhookReply {
+	if params == nil {
+		params = make(url.Values)
+	}
+	return &WebhookReply{vals: params, method: method}
+}
+
+// ReplySendMessage returns a WebhookReply that sends a text message,
+// taking the same arguments as API.SendMessage.
+func ReplySendMessage(text string, chatID int64, opts *MessageOptions) *WebhookReply {
+	var vals = make(url.Values)
+
+	vals.Set("text", text)
+	vals.Set("chat_id", itoa(chatID))
+	return NewWebhookReply("sendMessage", addValues(vals, opts))
+}
+
+// ReplyAnswerCallbackQuery returns a WebhookReply that answers a callback query,
+// taking the same arguments as API.AnswerCallbackQuery.
+func ReplyAnswerCallbackQuery(callbackID string, opts *CallbackQueryOptions) *WebhookReply {
+	var vals = make(url.Values)
+
+	vals.Set("callback_query_id", callbackID)
+	return NewWebhookReply("answerCallbackQuery", addValues(vals, opts))
+}
+
+// Method returns the name of the Telegram Bot API method called by the reply.
+func (w *WebhookReply) Method() string {
+	return w.method
+}
+
+// write writes the reply as the body of the webhook response.
+func (w *WebhookReply) write(rw http.ResponseWriter) error {
+	vals := make(url.Values, len(w.vals)+1)
+	for k, v := range w.vals {
+		vals[k] = v
+	}
+	vals.Set("method", w.method)
+
+	rw.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	rw.WriteHeader(http.StatusOK)
+	_, err := rw.Write([]byte(vals.Encode()))
+	return err
+}
+
+// call performs the reply as a regular API call, used when the webhook
+// request has already been answered.
+func (w *WebhookReply) call(a API) error {
+	var res APIResponseBase
+	return a.lclient.get(a.base, w.method, w.vals, &res)
+}
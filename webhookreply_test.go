@@ -0,0 +1,76 @@
+package echotron
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type replierBot struct {
+	delay time.Duration
+}
+
+func (r replierBot) Update(_ *Update) {}
+
+func (r replierBot) UpdateReply(u *Update) *WebhookReply {
+	time.Sleep(r.delay)
+	return ReplySendMessage("pong", u.Message.Chat.ID, nil)
+}
+
+func TestWebhookReply(t *testing.T) {
+	var (
+		calls = make(chan url.Values, 1)
+		delay time.Duration
+	)
+
+	d := NewDispatcher("token", func(_ int64) Bot { return replierBot{delay} })
+	d.SetWebhookReply(50 * time.Millisecond)
+	d.api = fakeAPI(t, func(method string, r *http.Request) string {
+		q := r.URL.Query()
+		q.Set("method", method)
+		calls <- q
+		return `{"ok":true,"result":{}}`
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":1,"message":{"chat":{"id":7}}}`))
+	rec := httptest.NewRecorder()
+	d.HandleWebhook(rec, req)
+
+	body, err := url.ParseQuery(rec.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Get("method") != "sendMessage" || body.Get("text") != "pong" || body.Get("chat_id") != "7" {
+		t.Fatalf("unexpected reply %v", body)
+	}
+
+	// The bot of chat 8 is too slow, so the reply falls back to an API call.
+	delay = 100 * time.Millisecond
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":2,"message":{"chat":{"id":8}}}`))
+	rec = httptest.NewRecorder()
+	d.HandleWebhook(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("expected empty response, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case q := <-calls:
+		if q.Get("method") != "sendMessage" || q.Get("chat_id") != "8" {
+			t.Fatalf("unexpected API call %v", q)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply not sent as API call")
+	}
+}
+
+func TestReplyAnswerCallbackQuery(t *testing.T) {
+	r := ReplyAnswerCallbackQuery("id", &CallbackQueryOptions{Text: "ok"})
+
+	if r.Method() != "answerCallbackQuery" || r.vals.Get("callback_query_id") != "id" || r.vals.Get("text") != "ok" {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+}